@@ -0,0 +1,219 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+// Package archive saves records as JSON Lines files.
+package archive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Config contains the settings of a Writer.
+type Config struct {
+	// Dir is the directory where files are written.
+	Dir string
+
+	// MaxSize is the size in bytes of the uncompressed records after which
+	// a new file is started. Zero means no limit.
+	MaxSize int64
+
+	// MaxAge is the time after which the current file is completed, even
+	// if no record is written, and a new file is started. Zero means no
+	// limit.
+	MaxAge time.Duration
+
+	// Compress indicates whether files are gzip compressed.
+	Compress bool
+}
+
+const (
+	// Extension is the extension of the files we write.
+	Extension = ".jsonl"
+
+	// GzipExtension is appended to Extension for compressed files.
+	GzipExtension = ".gz"
+
+	// PartialExtension is appended to the name of the file that is being
+	// written, and removed when the file is complete. Consumers should
+	// ignore files with this extension.
+	PartialExtension = ".part"
+)
+
+// ErrClosed is returned when writing into a closed Writer.
+var ErrClosed = errors.New("Archive writer is closed")
+
+// Writer writes records as JSON Lines files into a directory, starting a
+// new file when the current one grows too large or too old. Writer can be
+// used by multiple goroutines.
+type Writer struct {
+	config  Config
+	mu      sync.Mutex
+	file    *os.File
+	gzw     *gzip.Writer
+	bufw    *bufio.Writer
+	name    string
+	size    int64
+	created time.Time
+	timer   *time.Timer
+	closed  bool
+}
+
+// NewWriter creates a Writer using |config|. It creates the directory if
+// needed. Files are created lazily when the first record is written.
+func NewWriter(config Config) (*Writer, error) {
+	err := os.MkdirAll(config.Dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{config: config}, nil
+}
+
+// Write writes |record| encoded as JSON on a single line.
+func (w *Writer) Write(record interface{}) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	if w.file != nil && w.shouldRotate(int64(len(data))) {
+		err = w.finish()
+		if err != nil {
+			return err
+		}
+	}
+	if w.file == nil {
+		err = w.create()
+		if err != nil {
+			return err
+		}
+	}
+	_, err = w.bufw.Write(data)
+	if err != nil {
+		return err
+	}
+	w.size += int64(len(data))
+	// Flush such that every record is on disk as soon as possible
+	return w.flush()
+}
+
+// Close completes the current file and prevents further writes.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	w.closed = true
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	if w.file == nil {
+		return nil
+	}
+	return w.finish()
+}
+
+// shouldRotate returns whether we should start a new file before writing
+// |count| more bytes. We never rotate an empty file.
+func (w *Writer) shouldRotate(count int64) bool {
+	if w.size <= 0 {
+		return false
+	}
+	if w.config.MaxSize > 0 && w.size+count > w.config.MaxSize {
+		return true
+	}
+	return w.config.MaxAge > 0 && time.Since(w.created) >= w.config.MaxAge
+}
+
+// create creates a new partial file.
+func (w *Writer) create() error {
+	w.created = time.Now()
+	name := "ndt-" + w.created.UTC().Format("20060102T150405.000000000Z") +
+		Extension
+	if w.config.Compress {
+		name += GzipExtension
+	}
+	name = filepath.Join(w.config.Dir, name)
+	file, err := os.OpenFile(name+PartialExtension,
+		os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	var wr io.Writer = file
+	w.gzw = nil
+	if w.config.Compress {
+		w.gzw = gzip.NewWriter(file)
+		wr = w.gzw
+	}
+	w.file, w.bufw, w.name, w.size = file, bufio.NewWriter(wr), name, 0
+	if w.config.MaxAge > 0 {
+		if w.timer == nil {
+			w.timer = time.AfterFunc(w.config.MaxAge, w.expire)
+		} else {
+			w.timer.Reset(w.config.MaxAge)
+		}
+	}
+	return nil
+}
+
+// expire completes the current file when it reaches MaxAge, such that
+// the records are not left in a partial file while no record is written.
+func (w *Writer) expire() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	// The file may have been rotated while we were waiting for the lock,
+	// in which case the timer has been reset for the new file.
+	if w.closed || w.file == nil || time.Since(w.created) < w.config.MaxAge {
+		return
+	}
+	err := w.finish()
+	if err != nil {
+		log.Println("Cannot complete archive file:", err)
+	}
+}
+
+// flush flushes the buffered data to the file.
+func (w *Writer) flush() error {
+	err := w.bufw.Flush()
+	if err != nil {
+		return err
+	}
+	if w.gzw != nil {
+		return w.gzw.Flush()
+	}
+	return nil
+}
+
+// finish completes the current file and gives it its final name.
+func (w *Writer) finish() error {
+	file := w.file
+	w.file = nil
+	err := w.bufw.Flush()
+	if err == nil && w.gzw != nil {
+		err = w.gzw.Close()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(w.name+PartialExtension, w.name)
+}
@@ -0,0 +1,178 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package archive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+type record struct {
+	ID   int
+	Data string
+}
+
+// newTestWriter creates a Writer writing into a temporary directory.
+func newTestWriter(t *testing.T, config Config) *Writer {
+	dir, err := ioutil.TempDir("", "ndt-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Dir = filepath.Join(dir, "results")
+	w, err := NewWriter(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+// readRecords reads the records in the complete files of |dir|, in order.
+// Returns the records and the number of files.
+func readRecords(t *testing.T, dir string) ([]record, int) {
+	names, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	var records []record
+	var files int
+	for _, name := range names {
+		if strings.HasSuffix(name, PartialExtension) {
+			continue
+		}
+		files++
+		file, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rd io.Reader = file
+		if strings.HasSuffix(name, GzipExtension) {
+			rd, err = gzip.NewReader(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		scanner := bufio.NewScanner(rd)
+		for scanner.Scan() {
+			var r record
+			err = json.Unmarshal(scanner.Bytes(), &r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			records = append(records, r)
+		}
+		file.Close()
+	}
+	return records, files
+}
+
+func TestWriterRotatesBySize(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		w := newTestWriter(t, Config{MaxSize: 100, Compress: compress})
+		defer os.RemoveAll(filepath.Dir(w.config.Dir))
+		for i := 0; i < 10; i++ {
+			err := w.Write(record{i, strings.Repeat("x", 30)})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, files := readRecords(t, w.config.Dir)
+		if files != 4 {
+			t.Error("unexpected number of complete files: ", files)
+		}
+		err := w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, files := readRecords(t, w.config.Dir)
+		if files != 5 || len(records) != 10 {
+			t.Fatal("unexpected files or records: ", files, len(records))
+		}
+		for i, r := range records {
+			if r.ID != i {
+				t.Error("records out of order: ", records)
+				break
+			}
+		}
+	}
+}
+
+func TestWriterRotatesByAge(t *testing.T) {
+	w := newTestWriter(t, Config{MaxAge: 50 * time.Millisecond})
+	defer os.RemoveAll(filepath.Dir(w.config.Dir))
+	w.Write(record{0, "a"})
+	w.Write(record{1, "b"})
+	time.Sleep(100 * time.Millisecond)
+	w.Write(record{2, "c"})
+	w.Close()
+	records, files := readRecords(t, w.config.Dir)
+	if files != 2 || len(records) != 3 {
+		t.Fatal("unexpected files or records: ", files, len(records))
+	}
+}
+
+func TestWriterCompletesExpiredFile(t *testing.T) {
+	w := newTestWriter(t, Config{MaxAge: 50 * time.Millisecond})
+	defer os.RemoveAll(filepath.Dir(w.config.Dir))
+	defer w.Close()
+	w.Write(record{0, "a"})
+	time.Sleep(200 * time.Millisecond)
+	records, files := readRecords(t, w.config.Dir)
+	if files != 1 || len(records) != 1 {
+		t.Fatal("unexpected files or records: ", files, len(records))
+	}
+	if _, err := os.Stat(w.name + PartialExtension); !os.IsNotExist(err) {
+		t.Error("the partial file should have been renamed: ", err)
+	}
+}
+
+func TestWriterPartialFileIsReadable(t *testing.T) {
+	w := newTestWriter(t, Config{})
+	defer os.RemoveAll(filepath.Dir(w.config.Dir))
+	w.Write(record{0, "a"})
+	data, err := ioutil.ReadFile(w.name + PartialExtension)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "{\"ID\":0,\"Data\":\"a\"}\n" {
+		t.Errorf("unexpected partial file content: %q", data)
+	}
+	w.Close()
+}
+
+func TestWriterClosed(t *testing.T) {
+	w := newTestWriter(t, Config{})
+	defer os.RemoveAll(filepath.Dir(w.config.Dir))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(record{}); err != ErrClosed {
+		t.Error("expected ErrClosed, got: ", err)
+	}
+	if err := w.Close(); err != ErrClosed {
+		t.Error("expected ErrClosed, got: ", err)
+	}
+	_, files := readRecords(t, w.config.Dir)
+	if files != 0 {
+		t.Error("no file should have been written")
+	}
+}
+
+func TestWriterInvalidRecord(t *testing.T) {
+	w := newTestWriter(t, Config{})
+	defer os.RemoveAll(filepath.Dir(w.config.Dir))
+	defer w.Close()
+	if err := w.Write(make(chan int)); err == nil {
+		t.Error("expected an error")
+	}
+}
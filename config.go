@@ -0,0 +1,230 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/m-lab/ndt-server-go/netx"
+	"github.com/m-lab/ndt-server-go/protocol"
+	"github.com/m-lab/ndt-server-go/server"
+)
+
+// testsValue is a flag.Value for a comma separated list of test names.
+type testsValue struct {
+	tests *protocol.TestCode
+}
+
+func (tv testsValue) String() string {
+	if tv.tests == nil {
+		return ""
+	}
+	return server.FormatTests(*tv.tests)
+}
+
+func (tv testsValue) Set(s string) error {
+	tests, err := server.ParseTests(s)
+	if err != nil {
+		return err
+	}
+	*tv.tests = tests
+	return nil
+}
+
+// familyValue is a flag.Value for an IP family.
+type familyValue struct {
+	family *netx.Family
+}
+
+func (fv familyValue) String() string {
+	if fv.family == nil {
+		return ""
+	}
+	return fv.family.String()
+}
+
+func (fv familyValue) Set(s string) error {
+	family, err := netx.ParseFamily(s)
+	if err != nil {
+		return err
+	}
+	*fv.family = family
+	return nil
+}
+
+// listValue is a flag.Value for a comma separated list of strings.
+type listValue struct {
+	list *[]string
+}
+
+func (lv listValue) String() string {
+	if lv.list == nil {
+		return ""
+	}
+	return strings.Join(*lv.list, ",")
+}
+
+func (lv listValue) Set(s string) error {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	*lv.list = list
+	return nil
+}
+
+// newConfigFlagSet creates a flag.FlagSet whose flags are bound to the
+// fields of |config|. The flags names are also the config file keys.
+func newConfigFlagSet(config *server.Config) *flag.FlagSet {
+	fs := flag.NewFlagSet("ndt-server", flag.ContinueOnError)
+	fs.StringVar(&config.ControlAddress, "control-address",
+		config.ControlAddress, "address where to listen for control connections")
+	fs.IntVar(&config.DataPortMin, "data-port-min", config.DataPortMin,
+		"first port of the data ports range (0 means ephemeral ports)")
+	fs.IntVar(&config.DataPortMax, "data-port-max", config.DataPortMax,
+		"last port of the data ports range (0 means ephemeral ports)")
+	fs.BoolVar(&config.ReusePort, "reuse-port", config.ReusePort,
+		"whether the control listeners use SO_REUSEPORT")
+	fs.Var(familyValue{&config.IPFamily}, "ip-family",
+		"IP family of the listeners: dual (IPv4 and IPv6), ipv4 or ipv6 (IPv6 only)")
+	fs.DurationVar(&config.ControlTimeout, "control-timeout",
+		config.ControlTimeout, "timeout of the control connection I/O")
+	fs.DurationVar(&config.DataTimeout, "data-timeout", config.DataTimeout,
+		"timeout of the data connections I/O")
+	fs.DurationVar(&config.SessionTimeout, "session-timeout",
+		config.SessionTimeout, "time allowed to a session to complete (0 means no limit)")
+	fs.Var(testsValue{&config.EnabledTests}, "tests",
+		"comma separated list of enabled tests")
+	fs.DurationVar(&config.TestDuration, "test-duration", config.TestDuration,
+		"duration of the throughput tests")
+	fs.DurationVar(&config.MidDuration, "mid-duration", config.MidDuration,
+		"duration of the middlebox test")
+	fs.DurationVar(&config.SFWTimeout, "sfw-timeout", config.SFWTimeout,
+		"timeout of each direction of the simple firewall test")
+	fs.IntVar(&config.MaxStreams, "max-streams", config.MaxStreams,
+		"maximum number of streams of the extended tests")
+	fs.IntVar(&config.MaxActiveSessions, "max-active-sessions",
+		config.MaxActiveSessions, "maximum number of concurrent sessions (0 means no limit)")
+	fs.IntVar(&config.MaxQueuedSessions, "max-queued-sessions",
+		config.MaxQueuedSessions, "maximum number of sessions waiting in queue")
+	fs.DurationVar(&config.QueueHeartbeatInterval, "queue-heartbeat-interval",
+		config.QueueHeartbeatInterval, "interval between updates sent to queued clients")
+	fs.DurationVar(&config.DrainTimeout, "drain-timeout", config.DrainTimeout,
+		"time allowed to running sessions to complete when shutting down")
+	fs.StringVar(&config.OutputDir, "output-dir", config.OutputDir,
+		"directory where to save results (empty means do not save)")
+	fs.Int64Var(&config.OutputMaxSize, "output-max-size", config.OutputMaxSize,
+		"size in bytes after which a new results file is started (0 means no limit)")
+	fs.DurationVar(&config.OutputMaxAge, "output-max-age", config.OutputMaxAge,
+		"time after which a new results file is started (0 means no limit)")
+	fs.BoolVar(&config.OutputCompress, "output-gzip", config.OutputCompress,
+		"whether to gzip compress the results files")
+	fs.DurationVar(&config.TCPInfoInterval, "tcpinfo-interval",
+		config.TCPInfoInterval, "interval at which TCP_INFO is sampled during downloads (0 means never)")
+	fs.StringVar(&config.S2CCongestion, "s2c-congestion", config.S2CCongestion,
+		"congestion control used by downloads, e.g. bbr (empty means system default)")
+	fs.DurationVar(&config.DiagInterval, "diag-interval", config.DiagInterval,
+		"interval at which sock_diag is used to collect the data sockets state (0 means never)")
+	fs.Int64Var(&config.MaxEgressRate, "max-egress-rate", config.MaxEgressRate,
+		"maximum aggregate rate in bit/s of the data sent by the server (0 means no limit)")
+	fs.Var(listValue{&config.TrustedProxies}, "trusted-proxies",
+		"comma separated list of CIDRs of the proxies sending a PROXY protocol header")
+	return fs
+}
+
+// loadConfigFile loads the JSON config file at |path| into the flags of
+// |fs|, except the ones in |skip|. The file contains an object whose keys
+// are flags names and whose values are strings, numbers or booleans.
+func loadConfigFile(fs *flag.FlagSet, path string, skip map[string]bool) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var values map[string]json.RawMessage
+	err = json.Unmarshal(data, &values)
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	for name, raw := range values {
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("%s: unknown key: %q", path, name)
+		}
+		if skip[name] {
+			continue
+		}
+		var value string
+		if json.Unmarshal(raw, &value) != nil {
+			value = string(raw) // numbers and booleans
+		}
+		err = fs.Set(name, value)
+		if err != nil {
+			return fmt.Errorf("%s: invalid value for %q: %s", path, name, err)
+		}
+	}
+	return nil
+}
+
+// printConfig writes the configuration bound to the flags of |fs| to |w|
+// using the same format of the config file.
+func printConfig(w io.Writer, fs *flag.FlagSet) error {
+	values := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		values[f.Name] = f.Value.String()
+	})
+	data, err := json.MarshalIndent(values, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
+
+// parseConfig builds the configuration from the command line |args|. The
+// settings are taken from the defaults, then from the config file, if any,
+// then from the flags, which therefore override the config file. When
+// the -print-config flag is set, the configuration is written to |w|.
+func parseConfig(args []string, w io.Writer) (server.Config, bool, error) {
+	config := server.DefaultConfig()
+	fs := newConfigFlagSet(&config)
+	fs.SetOutput(w)
+	var configFile string
+	var printOnly bool
+	cmdline := flag.NewFlagSet("ndt-server", flag.ContinueOnError)
+	cmdline.SetOutput(w)
+	cmdline.StringVar(&configFile, "config", "", "path of the JSON config file")
+	cmdline.BoolVar(&printOnly, "print-config", false,
+		"print the effective configuration and exit")
+	fs.VisitAll(func(f *flag.Flag) {
+		cmdline.Var(f.Value, f.Name, f.Usage)
+	})
+	err := cmdline.Parse(args)
+	if err != nil {
+		return config, false, err
+	}
+	if configFile != "" {
+		explicit := make(map[string]bool)
+		cmdline.Visit(func(f *flag.Flag) {
+			explicit[f.Name] = true
+		})
+		err = loadConfigFile(fs, configFile, explicit)
+		if err != nil {
+			return config, false, err
+		}
+	}
+	err = config.Validate()
+	if err != nil {
+		return config, false, err
+	}
+	if printOnly {
+		err = printConfig(w, fs)
+	}
+	return config, printOnly, err
+}
@@ -0,0 +1,140 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server-go/netx"
+	"github.com/m-lab/ndt-server-go/protocol"
+	"github.com/m-lab/ndt-server-go/server"
+)
+
+// writeConfigFile writes |content| into a temporary config file.
+func writeConfigFile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "ndt-server-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.json")
+	err = ioutil.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseConfigDefaults(t *testing.T) {
+	config, printOnly, err := parseConfig(nil, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if printOnly {
+		t.Error("printOnly should be false")
+	}
+	if !reflect.DeepEqual(config, server.DefaultConfig()) {
+		t.Error("unexpected config: ", config)
+	}
+}
+
+func TestParseConfigFlagsOverrideFile(t *testing.T) {
+	path := writeConfigFile(t, `{
+		"control-address": ":3010",
+		"test-duration": "5s",
+		"max-active-sessions": 4,
+		"tests": "c2s,s2c",
+		"trusted-proxies": "10.0.0.0/8, 192.0.2.1"
+	}`)
+	defer os.RemoveAll(filepath.Dir(path))
+	config, _, err := parseConfig([]string{
+		"-config", path, "-test-duration", "7s", "-data-port-min", "4000",
+		"-data-port-max", "4010", "-reuse-port", "-ip-family", "ipv6",
+	}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ControlAddress != ":3010" || config.MaxActiveSessions != 4 {
+		t.Error("config file not applied: ", config)
+	}
+	if config.TestDuration != 7*time.Second {
+		t.Error("flags should override the config file: ", config.TestDuration)
+	}
+	if config.DataPortMin != 4000 || config.DataPortMax != 4010 || !config.ReusePort ||
+		config.IPFamily != netx.IPv6 {
+		t.Error("unexpected data ports range: ", config)
+	}
+	if config.EnabledTests != protocol.TestC2S|protocol.TestS2C {
+		t.Error("unexpected enabled tests: ", config.EnabledTests)
+	}
+	if !reflect.DeepEqual(config.TrustedProxies, []string{"10.0.0.0/8", "192.0.2.1"}) {
+		t.Error("unexpected trusted proxies: ", config.TrustedProxies)
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	for _, content := range []string{
+		`{"unknown-key": 1}`,
+		`{"test-duration": "forever"}`,
+		`{"tests": "c2s,upload"}`,
+		`{"ip-family": "ipx"}`,
+		`{"config": "other.json"}`,
+		`not json`,
+	} {
+		path := writeConfigFile(t, content)
+		_, _, err := parseConfig([]string{"-config", path}, ioutil.Discard)
+		if err == nil {
+			t.Error("expected an error for: ", content)
+		}
+		os.RemoveAll(filepath.Dir(path))
+	}
+	for _, args := range [][]string{
+		{"-config", "/nonexistent/config.json"},
+		{"-max-streams", "0"},
+		{"-data-port-min", "5000", "-data-port-max", "4000"},
+		{"-trusted-proxies", "10.0.0.1/64"},
+		{"-no-such-flag"},
+	} {
+		_, _, err := parseConfig(args, ioutil.Discard)
+		if err == nil {
+			t.Error("expected an error for: ", args)
+		}
+	}
+}
+
+func TestPrintConfigRoundTrip(t *testing.T) {
+	var output bytes.Buffer
+	config, printOnly, err := parseConfig([]string{
+		"-print-config", "-sfw-timeout", "2s", "-tests", "mid,meta",
+	}, &output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !printOnly {
+		t.Error("printOnly should be true")
+	}
+	var values map[string]string
+	err = json.Unmarshal(output.Bytes(), &values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values["sfw-timeout"] != "2s" || values["tests"] != "meta,mid" {
+		t.Error("unexpected printed config: ", output.String())
+	}
+	path := writeConfigFile(t, output.String())
+	defer os.RemoveAll(filepath.Dir(path))
+	loaded, _, err := parseConfig([]string{"-config", path}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, config) {
+		t.Error("the printed config cannot be loaded back: ", loaded)
+	}
+}
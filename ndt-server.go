@@ -1,55 +1,77 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"net"
 	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/m-lab/ndt-server-go/netx"
+	"github.com/m-lab/ndt-server-go/server"
 )
 
+// Exit codes:
 const (
-	// HOST is the host to listen on
-	HOST = "localhost"
-	// PORT is the port to listen on
-	PORT = "3001"
-	// TYPE is the protocol to listen on
-	TYPE = "tcp"
+	// exitServeError indicates that we could not listen or accept.
+	exitServeError = 1
+	// exitConfigError indicates that the configuration is invalid.
+	exitConfigError = 2
+	// exitDrainTimeout indicates that some sessions were still running
+	// when the drain timeout expired and have been interrupted.
+	exitDrainTimeout = 3
 )
 
-func handleRequest(conn net.Conn) {
-	// Make a buffer to hold incoming data.
-	buf := make([]byte, 1024)
-	// Read the incoming connection into the buffer.
-	reqLen, err := conn.Read(buf)
+func main() {
+	config, printOnly, err := parseConfig(os.Args[1:], os.Stdout)
+	if err == flag.ErrHelp {
+		return
+	}
 	if err != nil {
-		fmt.Println("Error reading:", err.Error())
+		fmt.Println("Error in configuration:", err.Error())
+		os.Exit(exitConfigError)
+	}
+	if printOnly {
+		return
 	}
-	fmt.Println(string(buf[:reqLen]))
-	// Send a response back to person contacting us.
-	conn.Write([]byte("Message received."))
-	// Close the connection when you're done with it.
-	conn.Close()
-}
 
-func main() {
-	l, err := net.Listen(TYPE, HOST+":"+PORT)
+	listeners, err := netx.NewTCPListeners(config.ControlAddress,
+		netx.ListenOptions{ReusePort: config.ReusePort, Family: config.IPFamily})
 	if err != nil {
 		fmt.Println("Error listening:", err.Error())
-		os.Exit(1)
-	}
-
-	// Close the listener when the application closes.
-	defer l.Close()
-
-	fmt.Println("Listening on " + HOST + ":" + PORT)
-	for {
-		// Listen for an incoming connection.
-		conn, err := l.Accept()
-		if err != nil {
-			fmt.Println("Error accepting: ", err.Error())
-			// TODO - should this be fatal?
-			os.Exit(1)
-		}
-		// Handle connections in a new goroutine.
-		go handleRequest(conn)
+		os.Exit(exitServeError)
+	}
+
+	srv, err := server.NewServer(config)
+	if err != nil {
+		fmt.Println("Error creating server:", err.Error())
+		os.Exit(exitServeError)
+	}
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		fmt.Println("Listening on " + l.Addr().String())
+		go func(l net.Listener) {
+			errs <- srv.Serve(l)
+		}(l)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case err = <-errs:
+		fmt.Println("Error accepting:", err.Error())
+		os.Exit(exitServeError)
+	case sig := <-sigs:
+		fmt.Println("Received", sig, "signal: draining sessions")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.DrainTimeout)
+	defer cancel()
+	err = srv.Shutdown(ctx)
+	if err != nil {
+		fmt.Println("Error draining sessions:", err.Error())
+		os.Exit(exitDrainTimeout)
 	}
 }
@@ -0,0 +1,83 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package netx
+
+import (
+	"errors"
+	"net"
+)
+
+// ErrInvalidFamily is returned when parsing an unknown IP family.
+var ErrInvalidFamily = errors.New("Invalid IP family")
+
+// Family is the IP family used by listeners or by a connection.
+type Family int
+
+const (
+	// DualStack means both IPv4 and IPv6. A listener on the unspecified
+	// address accepts connections of both families.
+	DualStack Family = iota
+	// IPv4 means IPv4 only.
+	IPv4
+	// IPv6 means IPv6 only. Listeners on the unspecified address do not
+	// accept IPv4 connections.
+	IPv6
+)
+
+// familyNames contains the names of the families.
+var familyNames = map[Family]string{
+	DualStack: "dual",
+	IPv4:      "ipv4",
+	IPv6:      "ipv6",
+}
+
+func (f Family) String() string {
+	if name, ok := familyNames[f]; ok {
+		return name
+	}
+	return "unknown family"
+}
+
+// network returns the name of the TCP network of the family, as used by
+// the net package.
+func (f Family) network() string {
+	switch f {
+	case IPv4:
+		return "tcp4"
+	case IPv6:
+		return "tcp6"
+	}
+	return "tcp"
+}
+
+// ParseFamily parses the name of a Family, i.e. "dual", "ipv4" or "ipv6".
+func ParseFamily(s string) (Family, error) {
+	for f, name := range familyNames {
+		if name == s {
+			return f, nil
+		}
+	}
+	return DualStack, ErrInvalidFamily
+}
+
+// IPFamily returns the family of |ip|, IPv4 if it is an IPv4-mapped IPv6
+// address, or DualStack if |ip| is nil or invalid.
+func IPFamily(ip net.IP) Family {
+	if ip.To4() != nil {
+		return IPv4
+	}
+	if ip.To16() != nil {
+		return IPv6
+	}
+	return DualStack
+}
+
+// AddrFamily returns the family of the TCP address |addr|, or DualStack
+// if |addr| is not a TCP address.
+func AddrFamily(addr net.Addr) Family {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return IPFamily(tcpAddr.IP)
+	}
+	return DualStack
+}
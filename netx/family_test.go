@@ -0,0 +1,116 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package netx
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+// supportsIPv6 returns whether we can listen on the IPv6 loopback.
+func supportsIPv6() bool {
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		return false
+	}
+	ln.Close()
+	return true
+}
+
+// canDial returns whether we can connect to |port| of |host|.
+func canDial(host string, port int) bool {
+	conn, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func TestParseFamily(t *testing.T) {
+	for _, f := range []Family{DualStack, IPv4, IPv6} {
+		parsed, err := ParseFamily(f.String())
+		if err != nil || parsed != f {
+			t.Error("cannot parse: ", f, err)
+		}
+	}
+	if _, err := ParseFamily("ipv5"); err != ErrInvalidFamily {
+		t.Error("expected ErrInvalidFamily, got: ", err)
+	}
+}
+
+func TestAddrFamily(t *testing.T) {
+	for _, c := range []struct {
+		addr   net.Addr
+		family Family
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}, IPv4},
+		{&net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1")}, IPv4},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1")}, IPv6},
+		{&net.TCPAddr{}, DualStack},
+		{&net.UnixAddr{Name: "/tmp/sock", Net: "unix"}, DualStack},
+	} {
+		if f := AddrFamily(c.addr); f != c.family {
+			t.Error("unexpected family of ", c.addr, ": ", f)
+		}
+	}
+}
+
+func TestNewTCPListenersFamily(t *testing.T) {
+	if !supportsIPv6() {
+		t.Skip("IPv6 is not available")
+	}
+	for _, reusePort := range []bool{false, true} {
+		for _, c := range []struct {
+			family     Family
+			ipv4, ipv6 bool
+		}{
+			{DualStack, true, true},
+			{IPv4, true, false},
+			{IPv6, false, true},
+		} {
+			listeners, err := NewTCPListeners(":0", ListenOptions{
+				ReusePort: reusePort,
+				Family:    c.family,
+			})
+			skipIfReusePortUnsupported(t, err)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(listeners) != 1 {
+				t.Fatal("expected a single listener, got: ", len(listeners))
+			}
+			port := listeners[0].Addr().(*net.TCPAddr).Port
+			if canDial("127.0.0.1", port) != c.ipv4 || canDial("::1", port) != c.ipv6 {
+				t.Error("unexpected families accepted by ", c.family,
+					" with ReusePort ", reusePort)
+			}
+			listeners[0].Close()
+		}
+	}
+}
+
+func TestNewTCPListenersResolvesHost(t *testing.T) {
+	listeners, err := NewTCPListeners("localhost:0", ListenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) <= 0 || len(listeners) > 2 {
+		t.Fatal("unexpected number of listeners: ", len(listeners))
+	}
+	families := make(map[Family]bool)
+	port := listeners[0].Addr().(*net.TCPAddr).Port
+	for _, ln := range listeners {
+		defer ln.Close()
+		addr := ln.Addr().(*net.TCPAddr)
+		if !addr.IP.IsLoopback() || addr.Port != port || families[IPFamily(addr.IP)] {
+			t.Error("unexpected listener address: ", addr)
+		}
+		families[IPFamily(addr.IP)] = true
+	}
+	if _, err := NewTCPListeners("localhost", ListenOptions{}); err == nil {
+		t.Error("expected an error for an address without port")
+	}
+}
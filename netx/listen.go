@@ -0,0 +1,95 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package netx
+
+import (
+	"errors"
+	"net"
+)
+
+// ErrReusePortUnsupported is returned when listening with ReusePort on a
+// platform where we do not support SO_REUSEPORT.
+var ErrReusePortUnsupported = errors.New("SO_REUSEPORT is not supported on this platform")
+
+// ListenOptions contains the options of the listeners created by netx.
+type ListenOptions struct {
+	// ReusePort sets SO_REUSEPORT and SO_REUSEADDR before binding, such
+	// that many sockets can listen on the same port, e.g. the old and the
+	// new server while restarting. Note that Go always sets SO_REUSEADDR,
+	// hence ports in TIME_WAIT can be reused even without ReusePort. Only
+	// supported on Linux and macOS.
+	ReusePort bool
+
+	// Family is the IP family of the listeners. With DualStack, which is
+	// the default, listeners on the unspecified address accept both IPv4
+	// and IPv6 connections. With IPv6, they only accept IPv6 connections.
+	Family Family
+}
+
+// listenTCP creates a TCP listener bound to |address| using |options|.
+func listenTCP(address string, options ListenOptions) (*net.TCPListener, error) {
+	network := options.Family.network()
+	if !options.ReusePort {
+		ln, err := net.Listen(network, address)
+		if err != nil {
+			return nil, err
+		}
+		return ln.(*net.TCPListener), nil
+	}
+	addr, err := net.ResolveTCPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := reusePortListener(addr, options.Family)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Addr: addr, Err: err}
+	}
+	return ln, nil
+}
+
+// NewTCPListeners creates the TCP listeners of |address| using |options|.
+// If the family is DualStack and the host of |address| resolves to both
+// IPv4 and IPv6 addresses, e.g. "localhost", there is a listener for the
+// first address of each family, both on the same port. Otherwise, there
+// is a single listener. The listeners are closed on error.
+func NewTCPListeners(address string, options ListenOptions) ([]net.Listener, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	addresses := []string{address}
+	if ip := net.ParseIP(host); options.Family == DualStack && host != "" &&
+		(ip == nil || !ip.IsUnspecified()) {
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return nil, err
+		}
+		addresses = nil
+		seen := make(map[Family]bool)
+		for _, ip := range ips {
+			if f := IPFamily(ip); !seen[f] {
+				seen[f] = true
+				addresses = append(addresses, net.JoinHostPort(ip.String(), port))
+			}
+		}
+	}
+	var listeners []net.Listener
+	for _, a := range addresses {
+		if len(listeners) > 0 {
+			// Use the same port, in case the port of |address| is zero
+			host, _, _ := net.SplitHostPort(a)
+			_, port, _ := net.SplitHostPort(listeners[0].Addr().String())
+			a = net.JoinHostPort(host, port)
+		}
+		ln, err := listenTCP(a, options)
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
@@ -0,0 +1,23 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package netx
+
+import "syscall"
+
+// soReusePort is SO_REUSEPORT.
+const soReusePort = syscall.SO_REUSEPORT
+
+// maxListenerBacklog returns the maximum listen backlog like the net
+// package does, falling back to SOMAXCONN if it cannot be read.
+func maxListenerBacklog() int {
+	n, err := syscall.SysctlUint32("kern.ipc.somaxconn")
+	if err != nil || n == 0 {
+		return syscall.SOMAXCONN
+	}
+	// The backlog is stored in a short.
+	if n > 1<<16-1 {
+		n = 1<<16 - 1
+	}
+	return int(n)
+}
@@ -0,0 +1,39 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package netx
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// soReusePort is SO_REUSEPORT, which syscall lacks on Linux.
+const soReusePort = 0xf
+
+// somaxconnPath is the file containing the maximum listen backlog.
+const somaxconnPath = "/proc/sys/net/core/somaxconn"
+
+// maxListenerBacklog returns the maximum listen backlog like the net
+// package does, falling back to SOMAXCONN if it cannot be read.
+func maxListenerBacklog() int {
+	data, err := ioutil.ReadFile(somaxconnPath)
+	if err != nil {
+		return syscall.SOMAXCONN
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return syscall.SOMAXCONN
+	}
+	n, err := strconv.Atoi(fields[0])
+	if err != nil || n <= 0 {
+		return syscall.SOMAXCONN
+	}
+	// Kernels before 4.1 store the backlog in an uint16.
+	if n > 1<<16-1 {
+		n = 1<<16 - 1
+	}
+	return n
+}
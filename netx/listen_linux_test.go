@@ -0,0 +1,28 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package netx
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMaxListenerBacklog(t *testing.T) {
+	data, err := ioutil.ReadFile(somaxconnPath)
+	if err != nil {
+		t.Skip("cannot read somaxconn: ", err)
+	}
+	expected, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected > 1<<16-1 {
+		expected = 1<<16 - 1
+	}
+	if backlog := maxListenerBacklog(); backlog != expected {
+		t.Errorf("expected %d, got %d", expected, backlog)
+	}
+}
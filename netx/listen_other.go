@@ -0,0 +1,14 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+//go:build !darwin && !linux
+// +build !darwin,!linux
+
+package netx
+
+import "net"
+
+// reusePortListener returns ErrReusePortUnsupported.
+func reusePortListener(addr *net.TCPAddr, ipFamily Family) (*net.TCPListener, error) {
+	return nil, ErrReusePortUnsupported
+}
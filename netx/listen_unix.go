@@ -0,0 +1,116 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+//go:build darwin || linux
+// +build darwin linux
+
+package netx
+
+import (
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// listenerBacklog caches the value returned by maxListenerBacklog.
+var listenerBacklog struct {
+	sync.Once
+	value int
+}
+
+// backlog returns the listen backlog of the sockets we create.
+func backlog() int {
+	listenerBacklog.Do(func() {
+		listenerBacklog.value = maxListenerBacklog()
+	})
+	return listenerBacklog.value
+}
+
+// reusePortListener creates a TCP listener of |ipFamily| bound to |addr|
+// with SO_REUSEPORT and SO_REUSEADDR set.
+func reusePortListener(addr *net.TCPAddr, ipFamily Family) (*net.TCPListener, error) {
+	fd, err := reusePortSocket(addr, ipFamily)
+	if err != nil {
+		return nil, err
+	}
+	// FileListener duplicates the descriptor, hence we close ours.
+	f := os.NewFile(uintptr(fd), "tcp:"+addr.String())
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, err
+	}
+	return ln.(*net.TCPListener), nil
+}
+
+// reusePortSocket returns a listening socket of |ipFamily| bound to |addr|
+// with SO_REUSEPORT and SO_REUSEADDR set. Like the net package, it uses a
+// dual stack IPv6 socket when |addr| has no IP and |ipFamily| is DualStack,
+// unless IPv6 is not available.
+func reusePortSocket(addr *net.TCPAddr, ipFamily Family) (int, error) {
+	family := syscall.AF_INET6
+	if ipFamily == IPv4 || (addr.IP != nil && addr.IP.To4() != nil) {
+		family = syscall.AF_INET
+	}
+	syscall.ForkLock.RLock()
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM, syscall.IPPROTO_TCP)
+	if err != nil && addr.IP == nil && ipFamily == DualStack {
+		family = syscall.AF_INET
+		fd, err = syscall.Socket(family, syscall.SOCK_STREAM, syscall.IPPROTO_TCP)
+	}
+	if err == nil {
+		syscall.CloseOnExec(fd)
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return -1, os.NewSyscallError("socket", err)
+	}
+	err = setupReusePortSocket(fd, family, addr, ipFamily == IPv6)
+	if err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// setupReusePortSocket sets the options of |fd|, binds it to |addr| and
+// starts listening. If |v6only| is false, IPv6 sockets on the unspecified
+// address accept IPv4 connections too.
+func setupReusePortSocket(fd, family int, addr *net.TCPAddr, v6only bool) error {
+	for _, opt := range []int{syscall.SO_REUSEADDR, soReusePort} {
+		err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, opt, 1)
+		if err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+	}
+	var sa syscall.Sockaddr
+	if family == syscall.AF_INET {
+		sa4 := &syscall.SockaddrInet4{Port: addr.Port}
+		if addr.IP != nil {
+			copy(sa4.Addr[:], addr.IP.To4())
+		}
+		sa = sa4
+	} else {
+		if addr.IP == nil || v6only {
+			value := 0
+			if v6only {
+				value = 1
+			}
+			err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6,
+				syscall.IPV6_V6ONLY, value)
+			if err != nil {
+				return os.NewSyscallError("setsockopt", err)
+			}
+		}
+		sa6 := &syscall.SockaddrInet6{Port: addr.Port}
+		copy(sa6.Addr[:], addr.IP.To16())
+		sa = sa6
+	}
+	err := syscall.Bind(fd, sa)
+	if err != nil {
+		return os.NewSyscallError("bind", err)
+	}
+	err = syscall.Listen(fd, backlog())
+	return os.NewSyscallError("listen", err)
+}
@@ -0,0 +1,181 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package netx
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultBinSize is the default size of the throughput bins.
+const DefaultBinSize = 250 * time.Millisecond
+
+// Measurement contains the bytes transferred in one direction of a
+// MeasuringConn. Times contain a monotonic clock reading, hence durations
+// computed from them are not affected by wall clock changes.
+type Measurement struct {
+	// Bytes is the number of bytes transferred.
+	Bytes int64
+	// Start is the time when the MeasuringConn was created.
+	Start time.Time
+	// First and Last are the times of the first and of the last byte. They
+	// are zero if no byte has been transferred.
+	First time.Time
+	Last  time.Time
+	// BinSize is the size of the throughput bins.
+	BinSize time.Duration
+	// Bins contains the bytes transferred in each bin, where the bin i
+	// starts at Start + i * BinSize.
+	Bins []int64
+}
+
+// Elapsed returns the time between Start and the last byte, or zero if no
+// byte has been transferred.
+func (m Measurement) Elapsed() time.Duration {
+	if m.Last.IsZero() {
+		return 0
+	}
+	return m.Last.Sub(m.Start)
+}
+
+// AverageKbps returns the average throughput in kbit/s between Start and
+// the last byte.
+func (m Measurement) AverageKbps() float64 {
+	elapsed := m.Elapsed()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(m.Bytes) * 8 / 1000 / elapsed.Seconds()
+}
+
+// BinsKbps returns the throughput in kbit/s of each bin. The last bin may
+// be still in progress, in which case its throughput is underestimated.
+func (m Measurement) BinsKbps() []float64 {
+	kbps := make([]float64, len(m.Bins))
+	for i, count := range m.Bins {
+		kbps[i] = float64(count) * 8 / 1000 / m.BinSize.Seconds()
+	}
+	return kbps
+}
+
+// meter accumulates the bytes transferred in one direction.
+type meter struct {
+	mu    sync.Mutex
+	first time.Time
+	last  time.Time
+	bins  []int64
+}
+
+// add adds |count| bytes transferred at |now| to the meter. The bins are
+// relative to |start| and have size |binSize|.
+func (m *meter) add(now, start time.Time, binSize time.Duration, count int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.first.IsZero() {
+		m.first = now
+	}
+	m.last = now
+	bin := int(now.Sub(start) / binSize)
+	if bin < 0 {
+		bin = 0
+	}
+	for len(m.bins) <= bin {
+		m.bins = append(m.bins, 0)
+	}
+	m.bins[bin] += int64(count)
+}
+
+// MeasuringConn is a net.Conn that counts the bytes read and written and
+// measures the throughput in each direction.
+type MeasuringConn struct {
+	// read and written are accessed atomically and must be the first
+	// fields to be 64-bit aligned on 32-bit platforms.
+	read    int64
+	written int64
+
+	net.Conn
+	start   time.Time
+	binSize time.Duration
+	reads   meter
+	writes  meter
+}
+
+// NewMeasuringConn creates a new MeasuringConn using |binSize| as the size
+// of the throughput bins. Zero and negative bin sizes cause DefaultBinSize
+// to be used.
+func NewMeasuringConn(conn net.Conn, binSize time.Duration) *MeasuringConn {
+	if binSize <= 0 {
+		binSize = DefaultBinSize
+	}
+	return &MeasuringConn{
+		Conn:    conn,
+		start:   time.Now(),
+		binSize: binSize,
+	}
+}
+
+// Read implements net.Conn.Read and counts the bytes read.
+func (mc *MeasuringConn) Read(data []byte) (int, error) {
+	count, err := mc.Conn.Read(data)
+	if count > 0 {
+		atomic.AddInt64(&mc.read, int64(count))
+		mc.reads.add(time.Now(), mc.start, mc.binSize, count)
+	}
+	return count, err
+}
+
+// Write implements net.Conn.Write and counts the bytes written.
+func (mc *MeasuringConn) Write(data []byte) (int, error) {
+	count, err := mc.Conn.Write(data)
+	if count > 0 {
+		atomic.AddInt64(&mc.written, int64(count))
+		mc.writes.add(time.Now(), mc.start, mc.binSize, count)
+	}
+	return count, err
+}
+
+// Start returns the time when |mc| was created.
+func (mc *MeasuringConn) Start() time.Time {
+	return mc.start
+}
+
+// BytesRead returns the number of bytes read so far.
+func (mc *MeasuringConn) BytesRead() int64 {
+	return atomic.LoadInt64(&mc.read)
+}
+
+// BytesWritten returns the number of bytes written so far.
+func (mc *MeasuringConn) BytesWritten() int64 {
+	return atomic.LoadInt64(&mc.written)
+}
+
+// ReadMeasurement returns the measurement of the bytes read so far.
+func (mc *MeasuringConn) ReadMeasurement() Measurement {
+	return mc.measurement(&mc.reads)
+}
+
+// WriteMeasurement returns the measurement of the bytes written so far.
+func (mc *MeasuringConn) WriteMeasurement() Measurement {
+	return mc.measurement(&mc.writes)
+}
+
+// measurement returns a copy of the state of |m|.
+func (mc *MeasuringConn) measurement(m *meter) Measurement {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var bytes int64
+	for _, count := range m.bins {
+		bytes += count
+	}
+	return Measurement{
+		Bytes:   bytes,
+		Start:   mc.start,
+		First:   m.first,
+		Last:    m.last,
+		BinSize: mc.binSize,
+		Bins:    append([]int64(nil), m.bins...),
+	}
+}
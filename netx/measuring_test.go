@@ -0,0 +1,97 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package netx
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMeasuringConnCountsBytes(t *testing.T) {
+	mc := NewMeasuringConn(mockedConn{}, 0)
+	if mc.binSize != DefaultBinSize {
+		t.Error("zero bin size should cause DefaultBinSize to be used")
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				mc.Read(make([]byte, 10))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				mc.Write(make([]byte, 20))
+			}
+		}()
+	}
+	wg.Wait()
+	if mc.BytesRead() != 4000 || mc.BytesWritten() != 8000 {
+		t.Error("unexpected counts: ", mc.BytesRead(), mc.BytesWritten())
+	}
+	r := mc.ReadMeasurement()
+	if r.Bytes != 4000 || r.First.Before(r.Start) || r.Last.Before(r.First) {
+		t.Errorf("unexpected read measurement: %+v", r)
+	}
+	w := mc.WriteMeasurement()
+	if w.Bytes != 8000 || w.First.Before(w.Start) || w.Last.Before(w.First) {
+		t.Errorf("unexpected write measurement: %+v", w)
+	}
+}
+
+func TestMeasuringConnIgnoresFailures(t *testing.T) {
+	mc := NewMeasuringConn(failRead{}, time.Second)
+	_, err := mc.Read(make([]byte, 10))
+	if err != errRead {
+		t.Fatal("unexpected error: ", err)
+	}
+	m := mc.ReadMeasurement()
+	if mc.BytesRead() != 0 || m.Bytes != 0 || !m.First.IsZero() ||
+		len(m.Bins) != 0 {
+		t.Errorf("failed reads should not be counted: %+v", m)
+	}
+	if m.Elapsed() != 0 || m.AverageKbps() != 0 {
+		t.Error("empty measurements should have zero throughput")
+	}
+}
+
+func TestMeasuringConnBins(t *testing.T) {
+	mc := NewMeasuringConn(mockedConn{}, 250*time.Millisecond)
+	at := func(d time.Duration) time.Time {
+		return mc.start.Add(d)
+	}
+	mc.writes.add(at(10*time.Millisecond), mc.start, mc.binSize, 1000)
+	mc.writes.add(at(200*time.Millisecond), mc.start, mc.binSize, 1500)
+	mc.writes.add(at(800*time.Millisecond), mc.start, mc.binSize, 3000)
+	mc.writes.add(at(time.Second), mc.start, mc.binSize, 500)
+	m := mc.WriteMeasurement()
+	expected := []int64{2500, 0, 0, 3000, 500}
+	if len(m.Bins) != len(expected) {
+		t.Fatal("unexpected bins: ", m.Bins)
+	}
+	for i := range expected {
+		if m.Bins[i] != expected[i] {
+			t.Fatal("unexpected bins: ", m.Bins)
+		}
+	}
+	if m.Bytes != 6000 || m.Elapsed() != time.Second {
+		t.Errorf("unexpected measurement: %+v", m)
+	}
+	if m.AverageKbps() != 48 {
+		t.Error("unexpected average throughput: ", m.AverageKbps())
+	}
+	kbps := m.BinsKbps()
+	if kbps[0] != 80 || kbps[1] != 0 || kbps[3] != 96 || kbps[4] != 16 {
+		t.Error("unexpected binned throughput: ", kbps)
+	}
+	// The returned bins are a copy
+	m.Bins[0] = 0
+	if mc.WriteMeasurement().Bins[0] != 2500 {
+		t.Error("the measurement should not alias the conn state")
+	}
+}
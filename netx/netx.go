@@ -7,44 +7,136 @@ package netx
 import (
 	"errors"
 	"net"
+	"sync"
 	"time"
 )
 
 // DeadlineConn is a net.Conn where I/O operations have deadlines. They will
 // fail with an error if it takes more than a specific time to complete them.
+// Reads and writes have separate timeouts. A DeadlineConn may also have a
+// session deadline after which all I/O fails regardless of the timeouts.
 type DeadlineConn struct {
 	net.Conn
-	timeout time.Duration
+
+	mu           sync.Mutex
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	deadline     time.Time
+	suspended    bool
 }
 
 // DefaultTimeout is the default timeout used by DeadlineConn.
 const DefaultTimeout = 10.0 * time.Second
 
 // NewDeadlineConn creates a new DeadlineConn.
-func NewDeadlineConn(conn net.Conn) DeadlineConn {
-	return DeadlineConn{
-		Conn:    conn,
-		timeout: DefaultTimeout,
+func NewDeadlineConn(conn net.Conn) *DeadlineConn {
+	return NewDeadlineConnWithTimeout(conn, DefaultTimeout)
+}
+
+// NewDeadlineConnWithTimeout creates a new DeadlineConn using |timeout| for
+// both reads and writes. Zero and negative timeouts cause DefaultTimeout to
+// be used.
+func NewDeadlineConnWithTimeout(conn net.Conn, timeout time.Duration) *DeadlineConn {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &DeadlineConn{
+		Conn:         conn,
+		readTimeout:  timeout,
+		writeTimeout: timeout,
 	}
 }
 
 // ErrInvalidTimeout is returned when you attempt to set an invalid timeout.
 var ErrInvalidTimeout = errors.New("Timeout is invalid")
 
-// SetTimeout sets the DeadlineConn timeout. Negative and zero timeouts cause
-// an ErrInvalidTimeout to be retured by this function.
-func (dc DeadlineConn) SetTimeout(timeout time.Duration) error {
+// SetTimeout sets both the read and the write timeouts. Negative and zero
+// timeouts cause an ErrInvalidTimeout to be retured by this function.
+func (dc *DeadlineConn) SetTimeout(timeout time.Duration) error {
+	if timeout <= 0 {
+		return ErrInvalidTimeout
+	}
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	dc.readTimeout = timeout
+	dc.writeTimeout = timeout
+	return nil
+}
+
+// SetReadTimeout sets the read timeout. Negative and zero timeouts cause an
+// ErrInvalidTimeout to be returned by this function.
+func (dc *DeadlineConn) SetReadTimeout(timeout time.Duration) error {
 	if timeout <= 0 {
 		return ErrInvalidTimeout
 	}
-	dc.timeout = timeout
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	dc.readTimeout = timeout
 	return nil
 }
 
+// SetWriteTimeout sets the write timeout. Negative and zero timeouts cause
+// an ErrInvalidTimeout to be returned by this function.
+func (dc *DeadlineConn) SetWriteTimeout(timeout time.Duration) error {
+	if timeout <= 0 {
+		return ErrInvalidTimeout
+	}
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	dc.writeTimeout = timeout
+	return nil
+}
+
+// Timeouts returns the read and the write timeouts.
+func (dc *DeadlineConn) Timeouts() (time.Duration, time.Duration) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	return dc.readTimeout, dc.writeTimeout
+}
+
+// SetSessionDeadline sets the time after which all I/O fails, regardless
+// of the read and write timeouts. The zero time removes the deadline.
+func (dc *DeadlineConn) SetSessionDeadline(deadline time.Time) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	dc.deadline = deadline
+}
+
+// Suspend suspends the read and write timeouts until Resume is called,
+// such that long bulk transfers are only bound by the session deadline.
+func (dc *DeadlineConn) Suspend() {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	dc.suspended = true
+}
+
+// Resume restores the read and write timeouts suspended by Suspend.
+func (dc *DeadlineConn) Resume() {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	dc.suspended = false
+}
+
+// nextDeadline returns the deadline of an I/O operation with |timeout|
+// starting now. The zero time means that there is no deadline.
+func (dc *DeadlineConn) nextDeadline(timeout time.Duration) time.Time {
+	if dc.suspended {
+		return dc.deadline
+	}
+	deadline := time.Now().Add(timeout)
+	if !dc.deadline.IsZero() && dc.deadline.Before(deadline) {
+		return dc.deadline
+	}
+	return deadline
+}
+
 // Read implements net.Conn.Read with a specific timeout.
-func (dc DeadlineConn) Read(data []byte) (int, error) {
+func (dc *DeadlineConn) Read(data []byte) (int, error) {
 	count := 0
-	err := dc.Conn.SetReadDeadline(time.Now().Add(dc.timeout))
+	dc.mu.Lock()
+	deadline := dc.nextDeadline(dc.readTimeout)
+	dc.mu.Unlock()
+	err := dc.Conn.SetReadDeadline(deadline)
 	if err != nil {
 		return count, err
 	}
@@ -54,9 +146,12 @@ func (dc DeadlineConn) Read(data []byte) (int, error) {
 }
 
 // Write implements net.Conn.Write with a specific timeout.
-func (dc DeadlineConn) Write(data []byte) (int, error) {
+func (dc *DeadlineConn) Write(data []byte) (int, error) {
 	count := 0
-	err := dc.Conn.SetWriteDeadline(time.Now().Add(dc.timeout))
+	dc.mu.Lock()
+	deadline := dc.nextDeadline(dc.writeTimeout)
+	dc.mu.Unlock()
+	err := dc.Conn.SetWriteDeadline(deadline)
 	if err != nil {
 		return count, err
 	}
@@ -68,11 +163,18 @@ func (dc DeadlineConn) Write(data []byte) (int, error) {
 // NewTCPListenerWithDeadline constructs a TCPListener that has a specific
 // deadline after which all pending Accept()s will fail.
 func NewTCPListenerWithDeadline(address string, deadline time.Time) (net.Listener, error) {
-	listener, err := net.Listen("tcp", address)
+	return NewTCPListenerWithOptions(address, deadline, ListenOptions{})
+}
+
+// NewTCPListenerWithOptions is like NewTCPListenerWithDeadline but creates
+// the listener using |options|.
+func NewTCPListenerWithOptions(address string, deadline time.Time,
+	options ListenOptions) (net.Listener, error) {
+	listener, err := listenTCP(address, options)
 	if err != nil {
 		return nil, err
 	}
-	err = listener.(*net.TCPListener).SetDeadline(deadline)
+	err = listener.SetDeadline(deadline)
 	if err != nil {
 		listener.Close()
 		return nil, err
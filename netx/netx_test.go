@@ -6,6 +6,7 @@ package netx
 import (
 	"errors"
 	"net"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -265,3 +266,191 @@ func TestDeadlineConnWriteWorks(t *testing.T) {
 		}
 	}
 }
+
+// Test: NewDeadlineConnWithTimeout
+
+func TestNewDeadlineConnWithTimeout(t *testing.T) {
+	dc := NewDeadlineConnWithTimeout(mockedConn{}, time.Second)
+	if r, w := dc.Timeouts(); r != time.Second || w != time.Second {
+		t.Error("the timeout was not set")
+	}
+	dc = NewDeadlineConnWithTimeout(mockedConn{}, 0)
+	if r, w := dc.Timeouts(); r != DefaultTimeout || w != DefaultTimeout {
+		t.Error("zero timeout should cause DefaultTimeout to be used")
+	}
+	dc = NewDeadlineConnWithTimeout(mockedConn{}, -1)
+	if r, w := dc.Timeouts(); r != DefaultTimeout || w != DefaultTimeout {
+		t.Error("negative timeout should cause DefaultTimeout to be used")
+	}
+}
+
+// Test: changed timeouts are honored
+
+// deadlineRecorder is a mockedConn that records the deadlines it is given.
+type deadlineRecorder struct {
+	mockedConn
+	read  *time.Time
+	write *time.Time
+}
+
+func newDeadlineRecorder() deadlineRecorder {
+	return deadlineRecorder{read: new(time.Time), write: new(time.Time)}
+}
+
+func (dr deadlineRecorder) SetReadDeadline(t time.Time) error {
+	*dr.read = t
+	return nil
+}
+
+func (dr deadlineRecorder) SetWriteDeadline(t time.Time) error {
+	*dr.write = t
+	return nil
+}
+
+// within returns whether |deadline| is |timeout| from now, give or take
+// some scheduling slack.
+func within(deadline time.Time, timeout time.Duration) bool {
+	left := time.Until(deadline)
+	return left <= timeout && left > timeout-time.Second
+}
+
+func TestDeadlineConnPerDirectionTimeouts(t *testing.T) {
+	dr := newDeadlineRecorder()
+	dc := NewDeadlineConn(dr)
+	if err := dc.SetReadTimeout(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := dc.SetWriteTimeout(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if dc.SetReadTimeout(0) != ErrInvalidTimeout ||
+		dc.SetWriteTimeout(-1) != ErrInvalidTimeout {
+		t.Error("invalid timeouts should be rejected")
+	}
+	dc.Read(make([]byte, 1))
+	dc.Write(make([]byte, 1))
+	if !within(*dr.read, time.Minute) {
+		t.Error("read timeout not honored: ", time.Until(*dr.read))
+	}
+	if !within(*dr.write, time.Hour) {
+		t.Error("write timeout not honored: ", time.Until(*dr.write))
+	}
+}
+
+func TestDeadlineConnChangedTimeoutIsHonored(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	dc := NewDeadlineConn(server)
+	if err := dc.SetTimeout(50 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, err := dc.Read(make([]byte, 1))
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Fatal("expected a timeout error, got: ", err)
+	}
+	if elapsed := time.Since(start); elapsed >= DefaultTimeout/2 {
+		t.Error("the new timeout was ignored: ", elapsed)
+	}
+}
+
+func TestDeadlineConnSessionDeadline(t *testing.T) {
+	dr := newDeadlineRecorder()
+	dc := NewDeadlineConnWithTimeout(dr, time.Hour)
+	deadline := time.Now().Add(time.Minute)
+	dc.SetSessionDeadline(deadline)
+	dc.Read(make([]byte, 1))
+	dc.Write(make([]byte, 1))
+	if !dr.read.Equal(deadline) || !dr.write.Equal(deadline) {
+		t.Error("the session deadline should bound the timeouts")
+	}
+	dc.SetSessionDeadline(time.Now().Add(2 * time.Hour))
+	dc.Read(make([]byte, 1))
+	if !within(*dr.read, time.Hour) {
+		t.Error("the timeout should apply before the session deadline")
+	}
+	dc.SetSessionDeadline(time.Time{})
+	dc.Write(make([]byte, 1))
+	if !within(*dr.write, time.Hour) {
+		t.Error("the zero session deadline should be ignored")
+	}
+}
+
+func TestDeadlineConnSuspendResume(t *testing.T) {
+	dr := newDeadlineRecorder()
+	dc := NewDeadlineConnWithTimeout(dr, time.Minute)
+	dc.Suspend()
+	dc.Read(make([]byte, 1))
+	dc.Write(make([]byte, 1))
+	if !dr.read.IsZero() || !dr.write.IsZero() {
+		t.Error("suspended timeouts should not set deadlines")
+	}
+	deadline := time.Now().Add(time.Hour)
+	dc.SetSessionDeadline(deadline)
+	dc.Write(make([]byte, 1))
+	if !dr.write.Equal(deadline) {
+		t.Error("the session deadline should apply while suspended")
+	}
+	dc.Resume()
+	dc.Read(make([]byte, 1))
+	if !within(*dr.read, time.Minute) {
+		t.Error("the timeout should apply after Resume")
+	}
+}
+
+// Test: NewTCPListenerWithOptions
+
+// skipIfReusePortUnsupported skips the test if |err| is caused by the lack
+// of support for SO_REUSEPORT on this platform.
+func skipIfReusePortUnsupported(t *testing.T, err error) {
+	if oe, ok := err.(*net.OpError); ok && oe.Err == ErrReusePortUnsupported {
+		t.Skip(err)
+	}
+}
+
+func TestNewTCPListenerWithOptionsReusePort(t *testing.T) {
+	first, err := NewTCPListenerWithOptions("127.0.0.1:0", time.Time{},
+		ListenOptions{ReusePort: true})
+	skipIfReusePortUnsupported(t, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	address := first.Addr().String()
+	_, err = NewTCPListenerWithDeadline(address, time.Time{})
+	if err == nil {
+		t.Fatal("binding a busy port without ReusePort should fail")
+	}
+	second, err := NewTCPListenerWithOptions(address, time.Time{},
+		ListenOptions{ReusePort: true})
+	if err != nil {
+		t.Fatal("binding a busy port with ReusePort should work: ", err)
+	}
+	defer second.Close()
+	if _, ok := second.(*net.TCPListener); !ok {
+		t.Error("the listener should be a TCPListener")
+	}
+}
+
+func TestNewTCPListenerWithOptionsDeadline(t *testing.T) {
+	ln, err := NewTCPListenerWithOptions(":0", time.Now(),
+		ListenOptions{ReusePort: true})
+	skipIfReusePortUnsupported(t, err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, err = ln.Accept()
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Error("expected a timeout, got: ", err)
+	}
+	// The dual stack listener accepts IPv4 connections
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.(*net.TCPListener).SetDeadline(time.Time{})
+	conn, err := net.Dial("tcp4", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,313 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+// Package netxtest contains network utilities for tests. Its Conn injects
+// faults (latency, short reads and writes, resets, stalls and corruption)
+// according to a script, to check how code behaves on hostile networks.
+package netxtest
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Direction selects the I/O operations affected by a Fault.
+type Direction int
+
+// The directions of a Conn.
+const (
+	// Read selects the reads.
+	Read Direction = 1 << iota
+	// Write selects the writes.
+	Write
+	// Both selects both reads and writes.
+	Both = Read | Write
+)
+
+// Kind is the kind of a Fault.
+type Kind int
+
+// The kinds of faults.
+const (
+	// Latency delays each operation by Duration plus a random jitter in
+	// the [0, Jitter) range.
+	Latency Kind = iota
+	// ShortIO transfers at most Size bytes per operation. Writes are split
+	// into many writes of the underlying conn, hence the peer sees data
+	// arriving in small pieces.
+	ShortIO
+	// Reset resets the connection when Offset bytes have been transferred.
+	// The operation crossing Offset is cut at Offset, and all subsequent
+	// operations fail with ErrReset.
+	Reset
+	// Stall blocks the first operation starting at Offset for Duration,
+	// or until the conn is closed or its deadline expires if Duration is
+	// zero. The operation crossing Offset is cut at Offset.
+	Stall
+	// Corrupt XORs Mask into the byte at Offset. A zero Mask flips the
+	// least significant bit.
+	Corrupt
+)
+
+// Fault is a fault injected in the I/O of a Conn. Latency and ShortIO
+// faults apply to all the operations starting at or after Offset, while
+// the other faults occur once, at Offset. Offsets count the bytes
+// transferred in each direction separately.
+type Fault struct {
+	Kind     Kind
+	Dir      Direction
+	Offset   int64
+	Duration time.Duration
+	Jitter   time.Duration
+	Size     int
+	Mask     byte
+}
+
+// ErrReset is returned by the operations of a Conn after a Reset fault.
+var ErrReset = errors.New("Connection reset by fault injection")
+
+// timeoutError is returned when a deadline expires while injecting a
+// fault. Like the errors of package net, it is a timeout net.Error.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// Conn is a net.Conn that injects faults in the I/O of the wrapped conn.
+type Conn struct {
+	net.Conn
+	faults []Fault
+
+	mu        sync.Mutex
+	rnd       *rand.Rand
+	offsets   [2]int64
+	fired     []bool
+	reset     bool
+	deadlines [2]time.Time
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewConn creates a Conn injecting |faults| in the I/O of |conn|. The
+// jitter is computed using a random source seeded with |seed|, hence a
+// Conn with the same |seed| and |faults| behaves the same way.
+func NewConn(conn net.Conn, seed int64, faults ...Fault) *Conn {
+	return &Conn{
+		Conn:   conn,
+		faults: faults,
+		rnd:    rand.New(rand.NewSource(seed)),
+		fired:  make([]bool, len(faults)),
+		closed: make(chan struct{}),
+	}
+}
+
+// index returns the index of |dir| in the per-direction arrays.
+func index(dir Direction) int {
+	if dir == Read {
+		return 0
+	}
+	return 1
+}
+
+// prepare injects the faults preceding an operation of |dir| that wants to
+// transfer |size| bytes. Returns how many bytes the operation can transfer.
+func (c *Conn) prepare(dir Direction, size int) (int, error) {
+	c.mu.Lock()
+	if c.reset {
+		c.mu.Unlock()
+		return 0, ErrReset
+	}
+	offset := c.offsets[index(dir)]
+	deadline := c.deadlines[index(dir)]
+	var delay time.Duration
+	forever := false
+	for i, f := range c.faults {
+		if f.Dir&dir == 0 {
+			continue
+		}
+		switch f.Kind {
+		case Latency:
+			if offset >= f.Offset {
+				delay += f.Duration
+				if f.Jitter > 0 {
+					delay += time.Duration(c.rnd.Int63n(int64(f.Jitter)))
+				}
+			}
+		case ShortIO:
+			if offset >= f.Offset && f.Size > 0 && size > f.Size {
+				size = f.Size
+			}
+		case Reset, Stall:
+			if c.fired[i] {
+				continue
+			}
+			if offset < f.Offset {
+				if left := f.Offset - offset; int64(size) > left {
+					size = int(left)
+				}
+				continue
+			}
+			c.fired[i] = true
+			if f.Kind == Reset {
+				c.reset = true
+				c.mu.Unlock()
+				c.abort()
+				return 0, ErrReset
+			}
+			delay += f.Duration
+			forever = forever || f.Duration <= 0
+		}
+	}
+	c.mu.Unlock()
+	if delay > 0 || forever {
+		err := c.wait(delay, forever, deadline)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return size, nil
+}
+
+// wait blocks for |delay|, or forever if |forever| is true, unless the
+// conn is closed or |deadline| expires first. Operations following a close
+// fail with the error of the wrapped conn.
+func (c *Conn) wait(delay time.Duration, forever bool, deadline time.Time) error {
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	var elapsed <-chan time.Time
+	if !forever {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		elapsed = timer.C
+	}
+	select {
+	case <-elapsed:
+		return nil
+	case <-expired:
+		return timeoutError{}
+	case <-c.closed:
+		return nil
+	}
+}
+
+// corrupt applies the Corrupt faults of |dir| to |data|, which starts at
+// the current offset, and advances the offset.
+func (c *Conn) corrupt(dir Direction, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	offset := c.offsets[index(dir)]
+	for _, f := range c.faults {
+		if f.Kind != Corrupt || f.Dir&dir == 0 {
+			continue
+		}
+		if f.Offset >= offset && f.Offset < offset+int64(len(data)) {
+			mask := f.Mask
+			if mask == 0 {
+				mask = 1
+			}
+			data[f.Offset-offset] ^= mask
+		}
+	}
+	c.offsets[index(dir)] += int64(len(data))
+}
+
+// abort closes the wrapped conn. TCP conns are closed with a RST.
+func (c *Conn) abort() {
+	if tcp, ok := c.Conn.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	c.Close()
+}
+
+// Read implements net.Conn.Read and injects faults.
+func (c *Conn) Read(data []byte) (int, error) {
+	size, err := c.prepare(Read, len(data))
+	if err != nil {
+		return 0, err
+	}
+	count, err := c.Conn.Read(data[:size])
+	c.corrupt(Read, data[:count])
+	return count, err
+}
+
+// Write implements net.Conn.Write and injects faults.
+func (c *Conn) Write(data []byte) (int, error) {
+	total := 0
+	for total < len(data) {
+		size, err := c.prepare(Write, len(data)-total)
+		if err != nil {
+			return total, err
+		}
+		chunk := append([]byte(nil), data[total:total+size]...)
+		c.corrupt(Write, chunk)
+		count, err := c.Conn.Write(chunk)
+		total += count
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// Close implements net.Conn.Close and interrupts the pending faults.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return c.Conn.Close()
+}
+
+// SetDeadline implements net.Conn.SetDeadline.
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadlines = [2]time.Time{t, t}
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline implements net.Conn.SetReadDeadline.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadlines[index(Read)] = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline implements net.Conn.SetWriteDeadline.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadlines[index(Write)] = t
+	c.mu.Unlock()
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// Listener is a net.Listener whose conns inject faults.
+type Listener struct {
+	net.Listener
+	seed   int64
+	faults []Fault
+}
+
+// NewListener creates a Listener wrapping the conns accepted by |ln| using
+// NewConn with |seed| and |faults|.
+func NewListener(ln net.Listener, seed int64, faults ...Fault) *Listener {
+	return &Listener{Listener: ln, seed: seed, faults: faults}
+}
+
+// Accept implements net.Listener.Accept.
+func (ln *Listener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(conn, ln.seed, ln.faults...), nil
+}
@@ -0,0 +1,204 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package netxtest_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server-go/netx/netxtest"
+)
+
+// newPair returns the two ends of a loopback TCP connection.
+func newPair(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := <-accepted
+	if peer == nil {
+		t.FailNow()
+	}
+	return conn, peer
+}
+
+func TestShortReads(t *testing.T) {
+	conn, peer := newPair(t)
+	defer peer.Close()
+	fc := netxtest.NewConn(conn, 0, netxtest.Fault{
+		Kind: netxtest.ShortIO, Dir: netxtest.Read, Size: 3,
+	})
+	defer fc.Close()
+	data := []byte("0123456789")
+	_, err := peer.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond) // let all data arrive
+	var got []byte
+	var counts []int
+	buf := make([]byte, 64)
+	for len(got) < len(data) {
+		n, err := fc.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, buf[:n]...)
+		counts = append(counts, n)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("unexpected data: ", string(got))
+	}
+	if len(counts) != 4 || counts[0] != 3 || counts[3] != 1 {
+		t.Error("reads are not short: ", counts)
+	}
+}
+
+func TestShortWritesWithLatency(t *testing.T) {
+	conn, peer := newPair(t)
+	defer peer.Close()
+	fc := netxtest.NewConn(conn, 1,
+		netxtest.Fault{Kind: netxtest.ShortIO, Dir: netxtest.Write, Size: 2},
+		netxtest.Fault{Kind: netxtest.Latency, Dir: netxtest.Both,
+			Duration: 5 * time.Millisecond, Jitter: 5 * time.Millisecond})
+	data := []byte("0123456789")
+	start := time.Now()
+	n, err := fc.Write(data)
+	if n != len(data) || err != nil {
+		t.Fatal("unexpected write result: ", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < 25*time.Millisecond {
+		t.Error("writes were not delayed: ", elapsed)
+	}
+	fc.Close()
+	got, err := ioutil.ReadAll(peer)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Error("unexpected data: ", string(got), err)
+	}
+}
+
+func TestResetAfterBytes(t *testing.T) {
+	conn, peer := newPair(t)
+	defer peer.Close()
+	fc := netxtest.NewConn(conn, 0, netxtest.Fault{
+		Kind: netxtest.Reset, Dir: netxtest.Write, Offset: 5,
+	})
+	n, err := fc.Write([]byte("0123456789"))
+	if n != 5 || err != netxtest.ErrReset {
+		t.Fatal("unexpected write result: ", n, err)
+	}
+	if _, err := fc.Read(make([]byte, 1)); err != netxtest.ErrReset {
+		t.Error("operations after a reset should fail: ", err)
+	}
+	got, err := ioutil.ReadAll(peer)
+	if string(got) != "01234" || err == nil {
+		t.Error("the peer should see a reset after 5 bytes: ", string(got), err)
+	}
+}
+
+func TestStallHonorsDeadline(t *testing.T) {
+	conn, peer := newPair(t)
+	defer peer.Close()
+	fc := netxtest.NewConn(conn, 0, netxtest.Fault{
+		Kind: netxtest.Stall, Dir: netxtest.Read, Offset: 2,
+	})
+	defer fc.Close()
+	_, err := peer.Write([]byte("0123"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	n, err := io.ReadFull(fc, buf[:2])
+	if n != 2 || err != nil {
+		t.Fatal("unexpected read result: ", n, err)
+	}
+	fc.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = fc.Read(buf)
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Fatal("expected a timeout, got: ", err)
+	}
+	// The stall occurs once
+	fc.SetReadDeadline(time.Time{})
+	n, err = io.ReadFull(fc, buf[:2])
+	if err != nil || string(buf[:n]) != "23" {
+		t.Error("unexpected read result after the stall: ", n, err)
+	}
+}
+
+func TestStallEndsOnClose(t *testing.T) {
+	conn, peer := newPair(t)
+	defer peer.Close()
+	fc := netxtest.NewConn(conn, 0, netxtest.Fault{
+		Kind: netxtest.Stall, Dir: netxtest.Write,
+	})
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		fc.Close()
+	}()
+	if _, err := fc.Write([]byte("x")); err == nil {
+		t.Error("writing on a closed conn should fail")
+	}
+}
+
+func TestCorrupt(t *testing.T) {
+	conn, peer := newPair(t)
+	defer peer.Close()
+	fc := netxtest.NewConn(conn, 0,
+		netxtest.Fault{Kind: netxtest.Corrupt, Dir: netxtest.Write, Offset: 1},
+		netxtest.Fault{Kind: netxtest.Corrupt, Dir: netxtest.Write, Offset: 6,
+			Mask: 0x20},
+		netxtest.Fault{Kind: netxtest.Corrupt, Dir: netxtest.Read, Offset: 1})
+	data := []byte("aaaa")
+	fc.Write(data)
+	fc.Write([]byte("aaaa"))
+	fc.Close()
+	if string(data) != "aaaa" {
+		t.Error("the caller buffer should not be corrupted")
+	}
+	got, err := ioutil.ReadAll(peer)
+	if err != nil || string(got) != "a`aaaaAa" {
+		t.Error("unexpected data: ", string(got), err)
+	}
+}
+
+func TestListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fl := netxtest.NewListener(ln, 0, netxtest.Fault{
+		Kind: netxtest.Reset, Dir: netxtest.Both,
+	})
+	defer fl.Close()
+	go func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err == nil {
+			defer conn.Close()
+		}
+	}()
+	conn, err := fl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != netxtest.ErrReset {
+		t.Error("accepted conns should inject faults: ", err)
+	}
+}
@@ -0,0 +1,101 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package netx
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// ErrInvalidPortRange is returned when you attempt to use an invalid range
+// of ports.
+var ErrInvalidPortRange = errors.New("Port range is invalid")
+
+// ErrPortRangeFull is returned when all the ports of a PortAllocator are
+// in use.
+var ErrPortRangeFull = errors.New("Port range is full")
+
+// PortAllocator hands out the ports of a range to their owners (e.g. the
+// sessions) and tracks which ports are in use by whom. Ports are handed out
+// in a round robin fashion, such that a released port is reused as late as
+// possible.
+type PortAllocator struct {
+	min int
+	max int
+
+	mu     sync.Mutex
+	owners map[int]string
+	next   int
+}
+
+// NewPortAllocator creates a PortAllocator handing out the ports from |min|
+// to |max|, both included.
+func NewPortAllocator(min, max int) (*PortAllocator, error) {
+	if min <= 0 || max > 65535 || min > max {
+		return nil, ErrInvalidPortRange
+	}
+	return &PortAllocator{
+		min:    min,
+		max:    max,
+		owners: make(map[int]string),
+		next:   min,
+	}, nil
+}
+
+// Size returns the number of ports in the range.
+func (pa *PortAllocator) Size() int {
+	return pa.max - pa.min + 1
+}
+
+// Allocate hands out a free port to |owner|. Returns ErrPortRangeFull if
+// all the ports are in use.
+func (pa *PortAllocator) Allocate(owner string) (int, error) {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	for i := 0; i < pa.Size(); i++ {
+		port := pa.next
+		pa.next++
+		if pa.next > pa.max {
+			pa.next = pa.min
+		}
+		if _, busy := pa.owners[port]; !busy {
+			pa.owners[port] = owner
+			return port, nil
+		}
+	}
+	return 0, ErrPortRangeFull
+}
+
+// Release makes |port| available again.
+func (pa *PortAllocator) Release(port int) {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	delete(pa.owners, port)
+}
+
+// ReleaseAll makes all the ports in use by |owner| available again.
+func (pa *PortAllocator) ReleaseAll(owner string) {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	for port, o := range pa.owners {
+		if o == owner {
+			delete(pa.owners, port)
+		}
+	}
+}
+
+// InUse returns the ports in use by |owner|, in ascending order.
+func (pa *PortAllocator) InUse(owner string) []int {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	var ports []int
+	for port, o := range pa.owners {
+		if o == owner {
+			ports = append(ports, port)
+		}
+	}
+	sort.Ints(ports)
+	return ports
+}
@@ -0,0 +1,59 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package netx
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNewPortAllocator(t *testing.T) {
+	for _, r := range [][2]int{{0, 10}, {10, 9}, {65000, 65536}} {
+		if _, err := NewPortAllocator(r[0], r[1]); err != ErrInvalidPortRange {
+			t.Error("expected ErrInvalidPortRange for: ", r)
+		}
+	}
+	pa, err := NewPortAllocator(4000, 4000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pa.Size() != 1 {
+		t.Error("unexpected size: ", pa.Size())
+	}
+}
+
+func TestPortAllocatorTracksOwners(t *testing.T) {
+	pa, err := NewPortAllocator(4000, 4002)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, owner := range []string{"a", "b", "a"} {
+		port, err := pa.Allocate(owner)
+		if err != nil || port != 4000+i {
+			t.Fatal("unexpected allocation: ", port, err)
+		}
+	}
+	if _, err := pa.Allocate("c"); err != ErrPortRangeFull {
+		t.Fatal("expected ErrPortRangeFull, got: ", err)
+	}
+	if !reflect.DeepEqual(pa.InUse("a"), []int{4000, 4002}) {
+		t.Error("unexpected ports of a: ", pa.InUse("a"))
+	}
+	pa.ReleaseAll("a")
+	if len(pa.InUse("a")) != 0 || !reflect.DeepEqual(pa.InUse("b"), []int{4001}) {
+		t.Error("ReleaseAll should only release the ports of its owner")
+	}
+	// Round robin: the least recently used free port comes first
+	for _, expected := range []int{4000, 4002} {
+		port, err := pa.Allocate("c")
+		if err != nil || port != expected {
+			t.Fatal("unexpected allocation: ", port, err)
+		}
+	}
+	pa.Release(4001)
+	port, err := pa.Allocate("d")
+	if err != nil || port != 4001 {
+		t.Error("released ports should be recycled: ", port, err)
+	}
+}
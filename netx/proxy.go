@@ -0,0 +1,310 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package netx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Spec: https://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+
+// ProxyHeader is a PROXY protocol header.
+type ProxyHeader struct {
+	// Version is the protocol version, 1 or 2.
+	Version int
+	// Source and Destination are the addresses of the original connection.
+	// They are nil when the proxy does not relay a connection (i.e. for
+	// UNKNOWN in version 1 and LOCAL in version 2), in which case the
+	// addresses of the connection with the proxy are used.
+	Source      *net.TCPAddr
+	Destination *net.TCPAddr
+}
+
+// ErrInvalidProxyHeader is returned when a connection from a trusted
+// source does not start with a valid PROXY protocol header.
+var ErrInvalidProxyHeader = errors.New("Invalid PROXY protocol header")
+
+// proxyV1Prefix starts the version 1 header.
+var proxyV1Prefix = []byte("PROXY ")
+
+// proxyV2Signature starts the version 2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	// proxyV1MaxLength is the maximum length of a version 1 header.
+	proxyV1MaxLength = 107
+	// proxyV2MaxLength bounds the address block of a version 2 header,
+	// which includes TLVs that we skip.
+	proxyV2MaxLength = 4096
+)
+
+// readProxyHeader reads a PROXY protocol header from |rd|. It never reads
+// past the header, hence |rd| can be used for reading the payload.
+func readProxyHeader(rd io.Reader) (*ProxyHeader, error) {
+	prefix := make([]byte, len(proxyV1Prefix))
+	_, err := io.ReadFull(rd, prefix)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(prefix, proxyV1Prefix) {
+		return readProxyV1(rd)
+	}
+	if bytes.Equal(prefix, proxyV2Signature[:len(prefix)]) {
+		return readProxyV2(rd)
+	}
+	return nil, ErrInvalidProxyHeader
+}
+
+// readProxyV1 reads the version 1 header following the prefix. Since the
+// header ends with CRLF, we read it one byte at a time.
+func readProxyV1(rd io.Reader) (*ProxyHeader, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLength-len(proxyV1Prefix) {
+			return nil, ErrInvalidProxyHeader
+		}
+		_, err := io.ReadFull(rd, b)
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	header := &ProxyHeader{Version: 1}
+	if fields[0] == "UNKNOWN" {
+		return header, nil
+	}
+	if len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6") {
+		return nil, ErrInvalidProxyHeader
+	}
+	header.Source = parseProxyV1Addr(fields[1], fields[3])
+	header.Destination = parseProxyV1Addr(fields[2], fields[4])
+	if header.Source == nil || header.Destination == nil ||
+		(header.Source.IP.To4() != nil) != (fields[0] == "TCP4") {
+		return nil, ErrInvalidProxyHeader
+	}
+	return header, nil
+}
+
+// parseProxyV1Addr parses the |ip| and |port| of a version 1 header.
+func parseProxyV1Addr(ip, port string) *net.TCPAddr {
+	addr := net.ParseIP(ip)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if addr == nil || err != nil {
+		return nil
+	}
+	return &net.TCPAddr{IP: addr, Port: int(p)}
+}
+
+// readProxyV2 reads the version 2 header following the prefix.
+func readProxyV2(rd io.Reader) (*ProxyHeader, error) {
+	rest := make([]byte, len(proxyV2Signature)-len(proxyV1Prefix)+4)
+	_, err := io.ReadFull(rd, rest)
+	if err != nil {
+		return nil, err
+	}
+	sig := len(proxyV2Signature) - len(proxyV1Prefix)
+	if !bytes.Equal(rest[:sig], proxyV2Signature[len(proxyV1Prefix):]) {
+		return nil, ErrInvalidProxyHeader
+	}
+	verCmd, family := rest[sig], rest[sig+1]
+	length := int(binary.BigEndian.Uint16(rest[sig+2:]))
+	if verCmd>>4 != 2 || length > proxyV2MaxLength {
+		return nil, ErrInvalidProxyHeader
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(rd, body)
+	if err != nil {
+		return nil, err
+	}
+	header := &ProxyHeader{Version: 2}
+	switch verCmd & 0xf {
+	case 0: // LOCAL
+		return header, nil
+	case 1: // PROXY
+	default:
+		return nil, ErrInvalidProxyHeader
+	}
+	var ipLen int
+	switch family {
+	case 0x11: // TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLen = net.IPv6len
+	default:
+		return nil, ErrInvalidProxyHeader
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, ErrInvalidProxyHeader
+	}
+	header.Source = &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), body[:ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLen:])),
+	}
+	header.Destination = &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), body[ipLen:2*ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(body[2*ipLen+2:])),
+	}
+	return header, nil
+}
+
+// ProxyConn is a connection from a trusted proxy that starts with a PROXY
+// protocol header. The header is read by the first call to Read, Header,
+// LocalAddr or RemoteAddr, such that a slow proxy does not block Accept.
+// LocalAddr and RemoteAddr return the addresses of the original connection,
+// while the embedded Conn is the connection with the proxy.
+type ProxyConn struct {
+	net.Conn
+	timeout time.Duration
+
+	once   sync.Once
+	header *ProxyHeader
+	err    error
+
+	mu           sync.Mutex
+	readDeadline time.Time
+}
+
+// Header reads the PROXY protocol header, if needed, and returns it.
+func (pc *ProxyConn) Header() (*ProxyHeader, error) {
+	pc.once.Do(func() {
+		pc.mu.Lock()
+		deadline := pc.readDeadline
+		pc.mu.Unlock()
+		limit := time.Now().Add(pc.timeout)
+		if deadline.IsZero() || limit.Before(deadline) {
+			pc.Conn.SetReadDeadline(limit)
+		}
+		pc.header, pc.err = readProxyHeader(pc.Conn)
+		pc.Conn.SetReadDeadline(deadline)
+	})
+	return pc.header, pc.err
+}
+
+// ProxyAddr returns the address of the proxy.
+func (pc *ProxyConn) ProxyAddr() net.Addr {
+	return pc.Conn.RemoteAddr()
+}
+
+// Read implements net.Conn.Read. Fails if the header is not valid.
+func (pc *ProxyConn) Read(data []byte) (int, error) {
+	_, err := pc.Header()
+	if err != nil {
+		return 0, err
+	}
+	return pc.Conn.Read(data)
+}
+
+// LocalAddr returns the destination of the original connection, or the
+// local address if the header does not contain it or is not valid.
+func (pc *ProxyConn) LocalAddr() net.Addr {
+	header, err := pc.Header()
+	if err != nil || header.Destination == nil {
+		return pc.Conn.LocalAddr()
+	}
+	return header.Destination
+}
+
+// RemoteAddr returns the source of the original connection, or the
+// address of the proxy if the header does not contain it or is not valid.
+func (pc *ProxyConn) RemoteAddr() net.Addr {
+	header, err := pc.Header()
+	if err != nil || header.Source == nil {
+		return pc.Conn.RemoteAddr()
+	}
+	return header.Source
+}
+
+// SetDeadline implements net.Conn.SetDeadline.
+func (pc *ProxyConn) SetDeadline(t time.Time) error {
+	pc.mu.Lock()
+	pc.readDeadline = t
+	pc.mu.Unlock()
+	return pc.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline implements net.Conn.SetReadDeadline.
+func (pc *ProxyConn) SetReadDeadline(t time.Time) error {
+	pc.mu.Lock()
+	pc.readDeadline = t
+	pc.mu.Unlock()
+	return pc.Conn.SetReadDeadline(t)
+}
+
+// ParseCIDRs parses a list of CIDRs, like "10.0.0.0/8". Plain IP addresses
+// are also accepted and match only themselves.
+func ParseCIDRs(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		if ip := net.ParseIP(s); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// ProxyListener is a net.Listener whose connections from trusted sources
+// are ProxyConns. Connections from other sources are returned unchanged,
+// so that untrusted clients cannot spoof their address.
+type ProxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+	timeout time.Duration
+}
+
+// NewProxyListener creates a new ProxyListener trusting the proxies whose
+// address is in |trusted|. Trusted proxies must send the header within
+// DefaultTimeout.
+func NewProxyListener(ln net.Listener, trusted []*net.IPNet) *ProxyListener {
+	return &ProxyListener{
+		Listener: ln,
+		trusted:  trusted,
+		timeout:  DefaultTimeout,
+	}
+}
+
+// isTrusted returns whether |addr| is the address of a trusted proxy.
+func (pl *ProxyListener) isTrusted(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range pl.trusted {
+		if n.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Accept implements net.Listener.Accept.
+func (pl *ProxyListener) Accept() (net.Conn, error) {
+	conn, err := pl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !pl.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &ProxyConn{Conn: conn, timeout: pl.timeout}, nil
+}
@@ -0,0 +1,189 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package netx
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// proxyV2 builds a version 2 header with |cmd|, |family| and |body|.
+func proxyV2(cmd, family byte, body []byte) []byte {
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, 0x20|cmd, family, byte(len(body)>>8), byte(len(body)))
+	return append(header, body...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := []byte{10, 0, 0, 1, 192, 0, 2, 1, 0x30, 0x39, 0x0b, 0xb9}
+	v6 := append(append(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")...),
+		0x30, 0x39, 0x0b, 0xb9, 0x01, 0x00, 0x01, 0xff) // with a TLV
+	cases := []struct {
+		input  []byte
+		source string
+		dest   string
+		err    error
+	}{
+		{[]byte("PROXY TCP4 10.0.0.1 192.0.2.1 12345 3001\r\n"),
+			"10.0.0.1:12345", "192.0.2.1:3001", nil},
+		{[]byte("PROXY TCP6 2001:db8::1 2001:db8::2 12345 3001\r\n"),
+			"[2001:db8::1]:12345", "[2001:db8::2]:3001", nil},
+		{[]byte("PROXY UNKNOWN\r\n"), "", "", nil},
+		{[]byte("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n"), "", "", nil},
+		{proxyV2(1, 0x11, v4), "10.0.0.1:12345", "192.0.2.1:3001", nil},
+		{proxyV2(1, 0x21, v6), "[2001:db8::1]:12345", "[2001:db8::2]:3001", nil},
+		{proxyV2(0, 0x00, nil), "", "", nil},
+		{[]byte("PROXY TCP4 10.0.0.1 192.0.2.1 12345\r\n"), "", "", ErrInvalidProxyHeader},
+		{[]byte("PROXY TCP4 10.0.0.1 192.0.2.1 12345 99999\r\n"), "", "", ErrInvalidProxyHeader},
+		{[]byte("PROXY TCP4 2001:db8::1 2001:db8::2 1 2\r\n"), "", "", ErrInvalidProxyHeader},
+		{[]byte("PROXY TCP4 " + string(bytes.Repeat([]byte("1"), 200)) + "\r\n"),
+			"", "", ErrInvalidProxyHeader},
+		{[]byte("GET / HTTP/1.1\r\n"), "", "", ErrInvalidProxyHeader},
+		{proxyV2(1, 0x11, v4[:8]), "", "", ErrInvalidProxyHeader},
+		{proxyV2(2, 0x11, v4), "", "", ErrInvalidProxyHeader},
+		{proxyV2(1, 0x12, v4), "", "", ErrInvalidProxyHeader}, // UDP
+	}
+	for i, c := range cases {
+		payload := []byte("payload")
+		rd := bytes.NewReader(append(append([]byte(nil), c.input...), payload...))
+		header, err := readProxyHeader(rd)
+		if err != c.err {
+			t.Error("case ", i, ": unexpected error: ", err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if c.source == "" {
+			if header.Source != nil || header.Destination != nil {
+				t.Error("case ", i, ": unexpected addresses: ", header)
+			}
+		} else if header.Source.String() != c.source ||
+			header.Destination.String() != c.dest {
+			t.Error("case ", i, ": unexpected addresses: ", header.Source,
+				header.Destination)
+		}
+		rest, _ := ioutil.ReadAll(rd)
+		if !bytes.Equal(rest, payload) {
+			t.Error("case ", i, ": the payload was consumed: ", string(rest))
+		}
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	nets, err := ParseCIDRs([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range []string{"10.1.2.3", "192.0.2.1", "2001:db8::1"} {
+		found := false
+		for _, n := range nets {
+			found = found || n.Contains(net.ParseIP(ip))
+		}
+		if !found {
+			t.Error("address not matched: ", ip)
+		}
+	}
+	if nets[1].Contains(net.ParseIP("192.0.2.2")) {
+		t.Error("plain addresses should only match themselves")
+	}
+	if _, err := ParseCIDRs([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("invalid CIDRs should be rejected")
+	}
+}
+
+// dialProxyListener dials a ProxyListener trusting |trusted|, sends |data|
+// and returns the accepted conn.
+func dialProxyListener(t *testing.T, trusted string, data string) net.Conn {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nets, err := ParseCIDRs([]string{trusted})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := NewProxyListener(ln, nets)
+	defer pl.Close()
+	go func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte(data))
+		ioutil.ReadAll(conn)
+	}()
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestProxyListenerTrusted(t *testing.T) {
+	conn := dialProxyListener(t, "127.0.0.0/8",
+		"PROXY TCP4 192.0.2.7 192.0.2.1 4444 3001\r\nhello")
+	defer conn.Close()
+	pc, ok := conn.(*ProxyConn)
+	if !ok {
+		t.Fatal("connections from trusted proxies should be ProxyConns")
+	}
+	if conn.RemoteAddr().String() != "192.0.2.7:4444" ||
+		conn.LocalAddr().String() != "192.0.2.1:3001" {
+		t.Error("unexpected addresses: ", conn.RemoteAddr(), conn.LocalAddr())
+	}
+	if pc.ProxyAddr().(*net.TCPAddr).IP.String() != "127.0.0.1" {
+		t.Error("unexpected proxy address: ", pc.ProxyAddr())
+	}
+	buf := make([]byte, 5)
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Error("unexpected payload: ", string(buf[:n]), err)
+	}
+}
+
+func TestProxyListenerUntrusted(t *testing.T) {
+	conn := dialProxyListener(t, "10.0.0.0/8",
+		"PROXY TCP4 192.0.2.7 192.0.2.1 4444 3001\r\n")
+	defer conn.Close()
+	if _, ok := conn.(*ProxyConn); ok {
+		t.Fatal("connections from untrusted sources should not be parsed")
+	}
+	buf := make([]byte, 5)
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "PROXY" {
+		t.Error("the header should be passed through: ", string(buf[:n]), err)
+	}
+}
+
+func TestProxyConnInvalidHeader(t *testing.T) {
+	conn := dialProxyListener(t, "127.0.0.1", "HELLO WORLD\r\n")
+	defer conn.Close()
+	if _, err := conn.Read(make([]byte, 1)); err != ErrInvalidProxyHeader {
+		t.Error("expected ErrInvalidProxyHeader, got: ", err)
+	}
+	if conn.RemoteAddr().(*net.TCPAddr).IP.String() != "127.0.0.1" {
+		t.Error("the proxy address should be used: ", conn.RemoteAddr())
+	}
+}
+
+func TestProxyConnHeaderTimeout(t *testing.T) {
+	conn := dialProxyListener(t, "127.0.0.1", "PROXY TCP4")
+	defer conn.Close()
+	pc := conn.(*ProxyConn)
+	pc.timeout = 50 * time.Millisecond
+	deadline := time.Now().Add(time.Hour)
+	pc.SetReadDeadline(deadline)
+	_, err := pc.Header()
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Fatal("a silent proxy should time out: ", err)
+	}
+	if !pc.readDeadline.Equal(deadline) {
+		t.Error("the read deadline was not preserved")
+	}
+}
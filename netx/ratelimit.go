@@ -0,0 +1,270 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package netx
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultBurst is the default burst size of a TokenBucket in bytes.
+const DefaultBurst = 64 * 1024
+
+// ErrInvalidRate is returned when you attempt to use an invalid rate.
+var ErrInvalidRate = errors.New("Rate is invalid")
+
+// TokenBucket limits the rate at which bytes are transferred. It holds at
+// most |burst| tokens and is refilled at |rate| tokens per second, where
+// each token allows to transfer a byte. A TokenBucket can be shared by
+// many connections, in which case it limits their aggregate rate.
+type TokenBucket struct {
+	rate  float64
+	burst int
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket creates a full TokenBucket with |rate| in bytes per
+// second and |burst| in bytes. Zero and negative bursts cause DefaultBurst
+// to be used. Returns ErrInvalidRate if |rate| is not positive.
+func NewTokenBucket(rate int64, burst int) (*TokenBucket, error) {
+	if rate <= 0 {
+		return nil, ErrInvalidRate
+	}
+	if burst <= 0 {
+		burst = DefaultBurst
+	}
+	return &TokenBucket{
+		rate:   float64(rate),
+		burst:  burst,
+		tokens: float64(burst),
+		last:   time.Now(),
+	}, nil
+}
+
+// Burst returns the burst size of |tb|.
+func (tb *TokenBucket) Burst() int {
+	return tb.burst
+}
+
+// reserve takes |count| tokens from the bucket and returns how long the
+// caller must wait before transferring |count| bytes. Tokens can go into
+// debt, such that concurrent callers are served in order.
+func (tb *TokenBucket) reserve(count int) time.Duration {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	now := time.Now()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > float64(tb.burst) {
+		tb.tokens = float64(tb.burst)
+	}
+	tb.last = now
+	tb.tokens -= float64(count)
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
+
+// release gives back |count| tokens taken by reserve for a transfer that
+// did not happen.
+func (tb *TokenBucket) release(count int) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.tokens += float64(count)
+	if tb.tokens > float64(tb.burst) {
+		tb.tokens = float64(tb.burst)
+	}
+}
+
+// Wait blocks until |count| bytes can be transferred.
+func (tb *TokenBucket) Wait(count int) {
+	if delay := tb.reserve(count); delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// RateLimit is a rate in bytes per second with a burst size in bytes. A
+// zero or negative Rate means no limit.
+type RateLimit struct {
+	Rate  int64
+	Burst int
+}
+
+// newBucket returns a TokenBucket enforcing |rl| or nil if |rl| does not
+// limit the rate.
+func (rl RateLimit) newBucket() *TokenBucket {
+	if rl.Rate <= 0 {
+		return nil
+	}
+	tb, _ := NewTokenBucket(rl.Rate, rl.Burst)
+	return tb
+}
+
+// RateLimits contains the limits of each direction of a connection.
+type RateLimits struct {
+	Read  RateLimit
+	Write RateLimit
+}
+
+// RateLimitedConn is a net.Conn whose reads and writes are limited by
+// token buckets. Reads and writes transfer at most a burst at a time.
+// Writes wait before sending, while reads wait after receiving, since we
+// only know how many bytes we got after reading them. Writes fail with a
+// timeout error when waiting would go past the write deadline, while reads
+// do not honor the read deadline when waiting.
+type RateLimitedConn struct {
+	net.Conn
+	read  []*TokenBucket
+	write []*TokenBucket
+
+	mu            sync.Mutex
+	writeDeadline time.Time
+}
+
+// NewRateLimitedConn creates a new RateLimitedConn whose reads are limited
+// by |read| and whose writes are limited by |write|. A nil bucket means no
+// limit. Buckets can be shared by many connections.
+func NewRateLimitedConn(conn net.Conn, read, write *TokenBucket) *RateLimitedConn {
+	rc := &RateLimitedConn{Conn: conn}
+	rc.addBuckets(read, write)
+	return rc
+}
+
+// addBuckets adds the |read| and |write| buckets, unless they are nil.
+func (rc *RateLimitedConn) addBuckets(read, write *TokenBucket) {
+	if read != nil {
+		rc.read = append(rc.read, read)
+	}
+	if write != nil {
+		rc.write = append(rc.write, write)
+	}
+}
+
+// chunkSize returns the largest amount of bytes that |buckets| allow to
+// transfer at once, or |size| if it is smaller.
+func chunkSize(buckets []*TokenBucket, size int) int {
+	for _, tb := range buckets {
+		if tb.burst < size {
+			size = tb.burst
+		}
+	}
+	return size
+}
+
+// wait blocks until all the |buckets| allow to transfer |count| bytes.
+// If that would go past |deadline|, it gives the tokens back, blocks until
+// |deadline| and returns false. The zero |deadline| means no deadline.
+func wait(buckets []*TokenBucket, count int, deadline time.Time) bool {
+	var delay time.Duration
+	for _, tb := range buckets {
+		if d := tb.reserve(count); d > delay {
+			delay = d
+		}
+	}
+	if delay <= 0 {
+		return true
+	}
+	if !deadline.IsZero() && time.Until(deadline) < delay {
+		for _, tb := range buckets {
+			tb.release(count)
+		}
+		time.Sleep(time.Until(deadline))
+		return false
+	}
+	time.Sleep(delay)
+	return true
+}
+
+// Read implements net.Conn.Read with rate limiting.
+func (rc *RateLimitedConn) Read(data []byte) (int, error) {
+	if len(rc.read) <= 0 {
+		return rc.Conn.Read(data)
+	}
+	count, err := rc.Conn.Read(data[:chunkSize(rc.read, len(data))])
+	if count > 0 {
+		wait(rc.read, count, time.Time{})
+	}
+	return count, err
+}
+
+// Write implements net.Conn.Write with rate limiting.
+func (rc *RateLimitedConn) Write(data []byte) (int, error) {
+	if len(rc.write) <= 0 {
+		return rc.Conn.Write(data)
+	}
+	total := 0
+	for total < len(data) {
+		chunk := data[total:]
+		chunk = chunk[:chunkSize(rc.write, len(chunk))]
+		rc.mu.Lock()
+		deadline := rc.writeDeadline
+		rc.mu.Unlock()
+		if !wait(rc.write, len(chunk), deadline) {
+			return total, &net.OpError{Op: "write", Net: rc.LocalAddr().Network(),
+				Source: rc.LocalAddr(), Addr: rc.RemoteAddr(),
+				Err: os.ErrDeadlineExceeded}
+		}
+		count, err := rc.Conn.Write(chunk)
+		total += count
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// SetDeadline implements net.Conn.SetDeadline.
+func (rc *RateLimitedConn) SetDeadline(t time.Time) error {
+	rc.mu.Lock()
+	rc.writeDeadline = t
+	rc.mu.Unlock()
+	return rc.Conn.SetDeadline(t)
+}
+
+// SetWriteDeadline implements net.Conn.SetWriteDeadline.
+func (rc *RateLimitedConn) SetWriteDeadline(t time.Time) error {
+	rc.mu.Lock()
+	rc.writeDeadline = t
+	rc.mu.Unlock()
+	return rc.Conn.SetWriteDeadline(t)
+}
+
+// RateLimitedListener is a net.Listener whose connections are rate
+// limited, both individually and in aggregate.
+type RateLimitedListener struct {
+	net.Listener
+	perConn RateLimits
+	read    *TokenBucket
+	write   *TokenBucket
+}
+
+// NewRateLimitedListener creates a new RateLimitedListener. Each accepted
+// connection is limited by |perConn|, and all of them together are limited
+// by |aggregate|.
+func NewRateLimitedListener(ln net.Listener, perConn, aggregate RateLimits) *RateLimitedListener {
+	return &RateLimitedListener{
+		Listener: ln,
+		perConn:  perConn,
+		read:     aggregate.Read.newBucket(),
+		write:    aggregate.Write.newBucket(),
+	}
+}
+
+// Accept implements net.Listener.Accept and returns a RateLimitedConn.
+func (rl *RateLimitedListener) Accept() (net.Conn, error) {
+	conn, err := rl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	rc := NewRateLimitedConn(conn, rl.perConn.Read.newBucket(),
+		rl.perConn.Write.newBucket())
+	rc.addBuckets(rl.read, rl.write)
+	return rc, nil
+}
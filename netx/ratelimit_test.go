@@ -0,0 +1,189 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package netx
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewTokenBucket(t *testing.T) {
+	if _, err := NewTokenBucket(0, 1); err != ErrInvalidRate {
+		t.Error("zero rate should be rejected")
+	}
+	if _, err := NewTokenBucket(-1, 1); err != ErrInvalidRate {
+		t.Error("negative rate should be rejected")
+	}
+	tb, err := NewTokenBucket(1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tb.Burst() != DefaultBurst {
+		t.Error("zero burst should cause DefaultBurst to be used")
+	}
+}
+
+func TestTokenBucketReserve(t *testing.T) {
+	tb, err := NewTokenBucket(1000, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := tb.reserve(100); d != 0 {
+		t.Error("a full bucket should allow a burst: ", d)
+	}
+	d := tb.reserve(100)
+	if d <= 90*time.Millisecond || d > 100*time.Millisecond {
+		t.Error("unexpected delay for an empty bucket: ", d)
+	}
+	// Tokens are in debt, hence the next caller waits longer
+	if d2 := tb.reserve(100); d2 <= d {
+		t.Error("concurrent callers should be served in order: ", d, d2)
+	}
+}
+
+// elapsedWriting returns the time it takes to write |count| bytes on |conn|
+// using writes of |size| bytes. It may be called from any goroutine.
+func elapsedWriting(t *testing.T, conn net.Conn, count, size int) time.Duration {
+	start := time.Now()
+	for written := 0; written < count; written += size {
+		n, err := conn.Write(make([]byte, size))
+		if n != size || err != nil {
+			t.Error("unexpected write result: ", n, err)
+			break
+		}
+	}
+	return time.Since(start)
+}
+
+func TestRateLimitedConnWrite(t *testing.T) {
+	tb, err := NewTokenBucket(100000, 10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := NewRateLimitedConn(mockedConn{}, nil, tb)
+	// The first 10 kB are the burst, the other 40 kB take 400 ms
+	elapsed := elapsedWriting(t, rc, 50000, 25000)
+	if elapsed < 350*time.Millisecond || elapsed > time.Second {
+		t.Error("the write rate was not honored: ", elapsed)
+	}
+}
+
+func TestRateLimitedConnWriteDeadline(t *testing.T) {
+	tb, err := NewTokenBucket(100000, 10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc := NewDeadlineConnWithTimeout(NewRateLimitedConn(mockedConn{}, nil, tb),
+		100*time.Millisecond)
+	// Writing 50 kB takes 400 ms, hence the write stops at the deadline
+	start := time.Now()
+	count, err := dc.Write(make([]byte, 50000))
+	elapsed := time.Since(start)
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Fatal("expected a timeout error, got: ", err)
+	}
+	if count >= 50000 || elapsed < 90*time.Millisecond || elapsed > 200*time.Millisecond {
+		t.Error("the write did not stop at the deadline: ", count, elapsed)
+	}
+	// The tokens of the aborted write are given back
+	if d := tb.reserve(0); d > 100*time.Millisecond {
+		t.Error("the bucket is still in debt: ", d)
+	}
+}
+
+func TestRateLimitedConnRead(t *testing.T) {
+	tb, err := NewTokenBucket(100000, 10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := NewRateLimitedConn(mockedConn{}, tb, nil)
+	start := time.Now()
+	total := 0
+	for total < 50000 {
+		n, err := rc.Read(make([]byte, 25000))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > tb.Burst() {
+			t.Fatal("reads should not exceed the burst size: ", n)
+		}
+		total += n
+	}
+	elapsed := time.Since(start)
+	if elapsed < 350*time.Millisecond || elapsed > time.Second {
+		t.Error("the read rate was not honored: ", elapsed)
+	}
+}
+
+func TestRateLimitedConnWithoutLimits(t *testing.T) {
+	rc := NewRateLimitedConn(failWrite{}, nil, nil)
+	if _, err := rc.Write(make([]byte, 1)); err != errWrite {
+		t.Error("unexpected error: ", err)
+	}
+	elapsed := elapsedWriting(t, NewRateLimitedConn(mockedConn{}, nil, nil),
+		1<<20, 1<<16)
+	if elapsed > 100*time.Millisecond {
+		t.Error("unlimited conns should not wait: ", elapsed)
+	}
+}
+
+// mockedListener is a net.Listener accepting mockedConns.
+type mockedListener struct {
+	net.Listener
+}
+
+func (mockedListener) Accept() (net.Conn, error) {
+	return mockedConn{}, nil
+}
+
+func TestRateLimitedListenerAggregate(t *testing.T) {
+	ln := NewRateLimitedListener(mockedListener{}, RateLimits{},
+		RateLimits{Write: RateLimit{Rate: 100000, Burst: 10000}})
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			elapsedWriting(t, conn, 25000, 5000)
+		}()
+	}
+	wg.Wait()
+	// Like for a single conn writing 50 kB
+	elapsed := time.Since(start)
+	if elapsed < 350*time.Millisecond || elapsed > time.Second {
+		t.Error("the aggregate rate was not honored: ", elapsed)
+	}
+}
+
+func TestRateLimitedListenerPerConn(t *testing.T) {
+	ln := NewRateLimitedListener(mockedListener{},
+		RateLimits{Write: RateLimit{Rate: 100000, Burst: 10000}}, RateLimits{})
+	var wg sync.WaitGroup
+	durations := make([]time.Duration, 2)
+	for i := range durations {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func(d *time.Duration) {
+			defer wg.Done()
+			*d = elapsedWriting(t, conn, 50000, 5000)
+		}(&durations[i])
+	}
+	wg.Wait()
+	// Each conn has its own bucket, hence they run in parallel
+	for _, elapsed := range durations {
+		if elapsed < 350*time.Millisecond || elapsed > time.Second {
+			t.Error("the per-conn rate was not honored: ", elapsed)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package protocol_test
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server-go/netx/netxtest"
+	"github.com/m-lab/ndt-server-go/protocol"
+)
+
+// hostileMessages are the messages sent over hostile networks.
+var hostileMessages = [][]byte{
+	[]byte(`{"msg": "v3.7.0", "tests": "63"}`),
+	[]byte(`{"msg": "0"}`),
+	[]byte{},
+}
+
+// sendHostile sends |hostileMessages| to the returned reader over a
+// loopback connection, where the sender injects |faults|.
+func sendHostile(t *testing.T, faults ...netxtest.Fault) (*bufio.Reader, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		fc := netxtest.NewConn(conn, 0, faults...)
+		defer fc.Close()
+		wr := bufio.NewWriter(fc)
+		for _, m := range hostileMessages {
+			if protocol.Send(wr, protocol.MsgExtendedLogin, m) != nil {
+				return
+			}
+		}
+	}()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bufio.NewReader(conn), conn
+}
+
+// readHostile reads the messages sent by sendHostile and returns how many
+// were correctly received and the first error.
+func readHostile(t *testing.T, rdr *bufio.Reader) (int, error) {
+	for i, expected := range hostileMessages {
+		msg, err := protocol.ReadMessage(rdr)
+		if err != nil {
+			return i, err
+		}
+		if msg.Header.MsgType != protocol.MsgExtendedLogin ||
+			!bytes.Equal(msg.Content, expected) {
+			t.Fatalf("message %d was received as %q", i, msg.Content)
+		}
+	}
+	return len(hostileMessages), nil
+}
+
+func TestReadMessageSplitAcrossReads(t *testing.T) {
+	rdr, conn := sendHostile(t,
+		netxtest.Fault{Kind: netxtest.ShortIO, Dir: netxtest.Write, Size: 1},
+		netxtest.Fault{Kind: netxtest.Latency, Dir: netxtest.Write,
+			Jitter: time.Millisecond})
+	defer conn.Close()
+	count, err := readHostile(t, rdr)
+	if count != len(hostileMessages) || err != nil {
+		t.Error("messages split across reads were not received: ", count, err)
+	}
+}
+
+func TestReadMessageSlowShortReads(t *testing.T) {
+	rdr, conn := sendHostile(t)
+	defer conn.Close()
+	fc := netxtest.NewConn(conn, 0,
+		netxtest.Fault{Kind: netxtest.ShortIO, Dir: netxtest.Read, Size: 2},
+		netxtest.Fault{Kind: netxtest.Latency, Dir: netxtest.Read,
+			Jitter: time.Millisecond})
+	rdr.Reset(fc)
+	count, err := readHostile(t, rdr)
+	if count != len(hostileMessages) || err != nil {
+		t.Error("messages read in small pieces were not received: ", count, err)
+	}
+}
+
+func TestReadMessageTruncated(t *testing.T) {
+	// The first message has a 3 byte header and a 33 byte body
+	for _, offset := range []int64{1, 3, 20} {
+		rdr, conn := sendHostile(t, netxtest.Fault{
+			Kind: netxtest.Reset, Dir: netxtest.Write, Offset: offset,
+		})
+		count, err := readHostile(t, rdr)
+		if count != 0 || err == nil {
+			t.Error("truncated message at ", offset, " was accepted")
+		}
+		if offset == 3 && err == io.EOF {
+			t.Error("truncation after the header should not be a clean EOF")
+		}
+		conn.Close()
+	}
+}
+
+func TestReadMessageCorruptedLength(t *testing.T) {
+	rdr, conn := sendHostile(t, netxtest.Fault{
+		Kind: netxtest.Corrupt, Dir: netxtest.Write, Offset: 1, Mask: 0x80,
+	})
+	defer conn.Close()
+	// The length becomes larger than the data sent before closing.
+	count, err := readHostile(t, rdr)
+	if count != 0 || err != io.ErrUnexpectedEOF {
+		t.Error("a corrupted length should make the message truncated: ", count, err)
+	}
+}
+
+func TestReadLoginCorruptedType(t *testing.T) {
+	rdr, conn := sendHostile(t, netxtest.Fault{
+		Kind: netxtest.Corrupt, Dir: netxtest.Write, Offset: 0, Mask: 0xff,
+	})
+	defer conn.Close()
+	_, err := protocol.ReadLogin(rdr)
+	if err == nil {
+		t.Error("a login with a corrupted type should be rejected")
+	}
+}
+
+func TestReadMessageStalled(t *testing.T) {
+	rdr, conn := sendHostile(t, netxtest.Fault{
+		Kind: netxtest.Stall, Dir: netxtest.Write, Offset: 10,
+		Duration: time.Second,
+	})
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	count, err := readHostile(t, rdr)
+	if nerr, ok := err.(net.Error); count != 0 || !ok || !nerr.Timeout() {
+		t.Error("a stalled message should time out: ", count, err)
+	}
+}
@@ -85,7 +85,7 @@ const (
 
 type header struct {
 	MsgType byte // The message type
-	Length  int16
+	Length  uint16
 }
 
 // Message contains a header and arbitrary content.
@@ -113,10 +113,13 @@ func ReadMessage(brdr *bufio.Reader) (Message, error) {
 	}
 	log.Println(hdr)
 	content := make([]byte, hdr.Length)
-	err = binary.Read(brdr, binary.BigEndian, content)
-	// TODO(bassosimone): decide whether we want to tolerate EOF (it
-	// seems to me the original protocol does not).
-	if err != nil && err != io.EOF {
+	_, err = io.ReadFull(brdr, content)
+	// A message truncated after its header is as broken as a message
+	// truncated in the middle of its content.
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
 		log.Println(err)
 		return Message{}, err
 	}
@@ -135,6 +138,9 @@ type Login struct {
 	IsExtended bool   // Type MsgExtendedLogin
 }
 
+// ErrInvalidLogin is returned when the login message is malformed.
+var ErrInvalidLogin = errors.New("Invalid login message")
+
 // ReadLogin reads the initial login message.
 func ReadLogin(brdr *bufio.Reader) (Login, error) {
 	msg, err := ReadMessage(brdr)
@@ -144,8 +150,13 @@ func ReadLogin(brdr *bufio.Reader) (Login, error) {
 
 	switch msg.Header.MsgType {
 	case MsgLogin:
-		// TODO(bassosimone): Handle legacy, without json
-		return Login{}, errors.New("not implemented")
+		// Handle legacy, without json: the first byte contains the tests
+		// bitmask and it's optionally followed by the version string.
+		if len(msg.Content) < 1 {
+			log.Println("Error: empty legacy login message")
+			return Login{}, ErrInvalidLogin
+		}
+		return Login{msg.Content[0], string(msg.Content[1:]), false}, nil
 
 	case MsgExtendedLogin:
 		// Handle extended, with json
@@ -170,7 +181,18 @@ func ReadLogin(brdr *bufio.Reader) (Login, error) {
 
 // SimpleMsg helps encoding json messages.
 type SimpleMsg struct {
-	Msg string `json:"msg, string"`
+	Msg string `json:"msg"`
+}
+
+// LegacyMarshaler is implemented by messages that know how to encode
+// themselves for clients that logged in using the legacy protocol.
+type LegacyMarshaler interface {
+	MarshalLegacy() []byte
+}
+
+// MarshalLegacy implements LegacyMarshaler.
+func (sm SimpleMsg) MarshalLegacy() []byte {
+	return []byte(sm.Msg)
 }
 
 // Send sends a raw message to the client.
@@ -185,7 +207,7 @@ func Send(wr *bufio.Writer, t byte, msg []byte) error {
 	if err != nil {
 		return err
 	}
-	err = binary.Write(wr, binary.BigEndian, int16(len(msg)))
+	err = binary.Write(wr, binary.BigEndian, uint16(len(msg)))
 	if err != nil {
 		return err
 	}
@@ -205,3 +227,97 @@ func SendJSON(wr *bufio.Writer, t byte, msg interface{}) error {
 	}
 	return Send(wr, t, j)
 }
+
+// ErrUnexpectedMessage is returned when the client sends a message whose
+// type is not the one mandated by the protocol at that point.
+var ErrUnexpectedMessage = errors.New("Unexpected message type")
+
+// ErrNoLegacyEncoding is returned when attempting to send to a client using
+// the legacy protocol a message that does not implement LegacyMarshaler.
+var ErrNoLegacyEncoding = errors.New("Message has no legacy encoding")
+
+// Conn is a NDT control connection. It remembers how the client logged in,
+// so that messages are framed accordingly: JSON for clients that logged in
+// using MsgExtendedLogin and raw strings for legacy clients.
+type Conn struct {
+	rdwr       *bufio.ReadWriter
+	isExtended bool
+}
+
+// NewConn creates a new Conn that uses |rdwr| for I/O.
+func NewConn(rdwr *bufio.ReadWriter) *Conn {
+	return &Conn{rdwr: rdwr}
+}
+
+// ReadLogin reads the initial login message and selects the framing that
+// will be used by all the subsequent messages.
+func (c *Conn) ReadLogin() (Login, error) {
+	login, err := ReadLogin(c.rdwr.Reader)
+	if err != nil {
+		return Login{}, err
+	}
+	c.isExtended = login.IsExtended
+	return login, nil
+}
+
+// NewConnLike creates a new Conn that uses |rdwr| for I/O and the same
+// framing as |c|. This is useful for the tests that exchange messages on
+// connections other than the control connection.
+func (c *Conn) NewConnLike(rdwr *bufio.ReadWriter) *Conn {
+	return &Conn{rdwr: rdwr, isExtended: c.isExtended}
+}
+
+// IsExtended returns whether the client logged in using MsgExtendedLogin.
+func (c *Conn) IsExtended() bool {
+	return c.isExtended
+}
+
+// Send sends |msg| as a message of type |t|, wrapping it into a SimpleMsg
+// if the client uses the JSON protocol.
+func (c *Conn) Send(t byte, msg []byte) error {
+	if c.isExtended {
+		return SendJSON(c.rdwr.Writer, t, SimpleMsg{Msg: string(msg)})
+	}
+	return Send(c.rdwr.Writer, t, msg)
+}
+
+// SendString is like Send but takes a string in input.
+func (c *Conn) SendString(t byte, msg string) error {
+	return c.Send(t, []byte(msg))
+}
+
+// SendJSON sends |msg| as a message of type |t|. If the client uses the
+// legacy protocol, |msg| must implement LegacyMarshaler.
+func (c *Conn) SendJSON(t byte, msg interface{}) error {
+	if c.isExtended {
+		return SendJSON(c.rdwr.Writer, t, msg)
+	}
+	lm, ok := msg.(LegacyMarshaler)
+	if !ok {
+		return ErrNoLegacyEncoding
+	}
+	return Send(c.rdwr.Writer, t, lm.MarshalLegacy())
+}
+
+// ReadString reads a message of type |t| and returns its body, unwrapping
+// it from a SimpleMsg if the client uses the JSON protocol.
+func (c *Conn) ReadString(t byte) (string, error) {
+	msg, err := ReadMessage(c.rdwr.Reader)
+	if err != nil {
+		return "", err
+	}
+	if msg.Header.MsgType != t {
+		log.Println("Expected message", t, "but got", msg.Header.MsgType)
+		return "", ErrUnexpectedMessage
+	}
+	if !c.isExtended {
+		return string(msg.Content), nil
+	}
+	var sm SimpleMsg
+	err = json.Unmarshal(msg.Content, &sm)
+	if err != nil {
+		log.Println(err)
+		return "", err
+	}
+	return sm.Msg, nil
+}
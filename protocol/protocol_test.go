@@ -34,6 +34,21 @@ func TestReadMessage(t *testing.T) {
 	}
 }
 
+func TestReadMessageLarge(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 65538))
+	m := bytes.Repeat([]byte("x"), 65535)
+	buf.Write([]byte{11, 0xff, 0xff})
+	buf.Write(m)
+
+	msg, err := protocol.ReadMessage(bufio.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Content) != len(m) {
+		t.Error("Wrong content length: ", len(msg.Content))
+	}
+}
+
 func TestReadMany(t *testing.T) {
 	buf := bytes.NewBuffer(make([]byte, 0, 200))
 	m := "{\"msg\": \"4.0.0.1\", \"tests\": \"63\"}"
@@ -100,7 +115,7 @@ func TestWriteMessage(t *testing.T) {
 	if msgType != 4 {
 		t.Error("unexpected message type: ", msgType)
 	}
-	var length int16 = 0
+	var length uint16 = 0
 	err = binary.Read(outputBuf, binary.BigEndian, &length)
 	if err != nil {
 		t.Error(err.Error())
@@ -113,3 +128,142 @@ func TestWriteMessage(t *testing.T) {
 		t.Error("unexpected message body: ", body)
 	}
 }
+
+func TestReadLogin2(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 200))
+	buf.Write([]byte{2, 0, 7, 63})
+	buf.WriteString("v3.7.0")
+
+	login, err := protocol.ReadLogin(bufio.NewReader(buf))
+	if err != nil {
+		t.Error(err.Error())
+	}
+	if login.IsExtended {
+		t.Error("IsExtended should be false")
+	}
+	if login.Version != "v3.7.0" {
+		t.Error("Version incorrectly parsed: ", login.Version)
+	}
+	if login.Tests != 63 {
+		t.Error("Tests should be 63: ", login.Tests)
+	}
+}
+
+func TestReadLogin2WithoutVersion(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 200))
+	buf.Write([]byte{2, 0, 1, 4})
+
+	login, err := protocol.ReadLogin(bufio.NewReader(buf))
+	if err != nil {
+		t.Error(err.Error())
+	}
+	if login.IsExtended || login.Version != "" || login.Tests != 4 {
+		t.Error("Login incorrectly parsed: ", login)
+	}
+}
+
+func TestReadLogin2Empty(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 200))
+	buf.Write([]byte{2, 0, 0})
+
+	_, err := protocol.ReadLogin(bufio.NewReader(buf))
+	if err != protocol.ErrInvalidLogin {
+		t.Error("expected ErrInvalidLogin, got: ", err)
+	}
+}
+
+// newConnAfterLogin returns a Conn that has read |login| along with the
+// buffer where the messages sent by the Conn are written.
+func newConnAfterLogin(t *testing.T, login []byte) (*protocol.Conn, *bytes.Buffer) {
+	input := bytes.NewBuffer(login)
+	output := bytes.NewBuffer(make([]byte, 0, 200))
+	conn := protocol.NewConn(bufio.NewReadWriter(
+		bufio.NewReader(input), bufio.NewWriter(output)))
+	_, err := conn.ReadLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, output
+}
+
+func TestConnLegacyFraming(t *testing.T) {
+	conn, output := newConnAfterLogin(t, []byte{2, 0, 1, 63})
+	if conn.IsExtended() {
+		t.Error("IsExtended should be false")
+	}
+	err := conn.SendString(protocol.MsgLogin, "v3.7.0")
+	if err != nil {
+		t.Error(err.Error())
+	}
+	err = conn.SendJSON(protocol.MsgLogin, protocol.SimpleMsg{Msg: "1 2"})
+	if err != nil {
+		t.Error(err.Error())
+	}
+	err = conn.SendJSON(protocol.MsgLogin, map[string]string{})
+	if err != protocol.ErrNoLegacyEncoding {
+		t.Error("expected ErrNoLegacyEncoding, got: ", err)
+	}
+	expect := "\x02\x00\x06v3.7.0\x02\x00\x031 2"
+	if output.String() != expect {
+		t.Errorf("unexpected output: %q", output.String())
+	}
+}
+
+func TestConnExtendedFraming(t *testing.T) {
+	m := "{\"msg\": \"4.0.0.1\", \"tests\": \"63\"}"
+	conn, output := newConnAfterLogin(t, append([]byte{11, 0, byte(len(m))}, m...))
+	if !conn.IsExtended() {
+		t.Error("IsExtended should be true")
+	}
+	err := conn.SendString(protocol.MsgLogin, "v3.7.0")
+	if err != nil {
+		t.Error(err.Error())
+	}
+	expect := "\x02\x00\x10{\"msg\":\"v3.7.0\"}"
+	if output.String() != expect {
+		t.Errorf("unexpected output: %q", output.String())
+	}
+}
+
+func TestConnReadString(t *testing.T) {
+	m := "{\"msg\": \"4.0.0.1\", \"tests\": \"63\"}"
+	input := bytes.NewBuffer(append([]byte{11, 0, byte(len(m))}, m...))
+	m = "{\"msg\": \"1234\"}"
+	input.Write([]byte{5, 0, byte(len(m))})
+	input.WriteString(m)
+	input.Write([]byte{6, 0, 0})
+	conn := protocol.NewConn(bufio.NewReadWriter(
+		bufio.NewReader(input), bufio.NewWriter(bytes.NewBuffer(nil))))
+	_, err := conn.ReadLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := conn.ReadString(protocol.MsgTest)
+	if err != nil {
+		t.Error(err.Error())
+	}
+	if s != "1234" {
+		t.Error("unexpected message body: ", s)
+	}
+	_, err = conn.ReadString(protocol.MsgTest)
+	if err != protocol.ErrUnexpectedMessage {
+		t.Error("expected ErrUnexpectedMessage, got: ", err)
+	}
+}
+
+func TestConnNewConnLike(t *testing.T) {
+	conn, _ := newConnAfterLogin(t, []byte{2, 0, 1, 63})
+	output := bytes.NewBuffer(make([]byte, 0, 200))
+	other := conn.NewConnLike(bufio.NewReadWriter(
+		bufio.NewReader(bytes.NewBuffer(nil)), bufio.NewWriter(output)))
+	if other.IsExtended() {
+		t.Error("IsExtended should be false")
+	}
+	err := other.SendString(protocol.MsgTest, "abc")
+	if err != nil {
+		t.Error(err.Error())
+	}
+	if output.String() != "\x05\x00\x03abc" {
+		t.Errorf("unexpected output: %q", output.String())
+	}
+}
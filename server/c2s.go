@@ -0,0 +1,70 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/m-lab/ndt-server-go/netx"
+	"github.com/m-lab/ndt-server-go/protocol"
+)
+
+// c2sBufferSize is the size of the buffer used to read in the C2S test.
+const c2sBufferSize = 8192
+
+// recvData reads and discards data from |conn| until the client closes the
+// connection or |duration| has elapsed. Returns the number of bytes read
+// and the time elapsed until the last byte was read.
+func recvData(conn net.Conn, duration time.Duration) (int64, time.Duration, error) {
+	buf := make([]byte, c2sBufferSize)
+	mc := netx.NewMeasuringConn(conn, 0)
+	var err error
+	for time.Since(mc.Start()) < duration {
+		_, err = mc.Read(buf)
+		if err != nil {
+			break
+		}
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	m := mc.ReadMeasurement()
+	return m.Bytes, m.Elapsed(), err
+}
+
+// runC2S runs the single-stream upload test.
+func runC2S(s *Session) error {
+	ln, port, err := s.listenData()
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	conn, _, err := s.acceptData(ln, port)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = s.sendMsg(protocol.MsgTestStart, "")
+	if err != nil {
+		return err
+	}
+
+	total, elapsed, err := recvData(s.bulkConn(conn), s.config.TestDuration)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+
+	throughput := kbps(total, elapsed)
+	err = s.sendMsg(protocol.MsgTest, fmt.Sprintf("%.0f", throughput))
+	if err != nil {
+		return err
+	}
+	s.addResult("C2SThroughput", throughput)
+	s.addResult("C2STotalRecvByte", total)
+	return s.sendMsg(protocol.MsgTestFinalize, "")
+}
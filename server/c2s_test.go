@@ -0,0 +1,103 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package server
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server-go/protocol"
+)
+
+// runC2S runs the client side of the C2S test for |duration| and returns
+// the number of bytes sent and the throughput measured by the server.
+func (tc *testClient) runC2S(duration time.Duration) (int64, float64) {
+	conn := tc.dialData()
+	defer conn.Close()
+	tc.expect(protocol.MsgTestStart)
+	buf := make([]byte, 8192)
+	var total int64
+	start := time.Now()
+	for time.Since(start) < duration {
+		count, err := conn.Write(buf)
+		total += int64(count)
+		if err != nil {
+			break
+		}
+	}
+	conn.Close()
+	throughput, err := strconv.ParseFloat(tc.expect(protocol.MsgTest), 64)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	tc.expect(protocol.MsgTestFinalize)
+	return total, throughput
+}
+
+func TestC2S(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.conn.Close()
+	suite := tc.login("18")
+	if suite != "2" {
+		t.Fatal("unexpected tests suite: ", suite)
+	}
+	total, throughput := tc.runC2S(100 * time.Millisecond)
+	if total <= 0 || throughput <= 0 {
+		t.Error("unexpected measurement: ", total, throughput)
+	}
+	results := tc.logout()
+	if !strings.Contains(results, "C2STotalRecvByte: "+strconv.FormatInt(total, 10)) {
+		t.Error("unexpected results: ", results)
+	}
+}
+
+func TestC2SAndS2C(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.conn.Close()
+	tc.legacy = true
+	suite := tc.login("22")
+	if suite != "2 4" {
+		t.Fatal("unexpected tests suite: ", suite)
+	}
+	tc.runC2S(100 * time.Millisecond)
+	tc.runS2C()
+	tc.send(protocol.MsgTest, "1234")
+	tc.readTestMsgs()
+	results := tc.logout()
+	if !strings.Contains(results, "C2SThroughput: ") ||
+		!strings.Contains(results, "S2CServerThroughput: ") {
+		t.Error("unexpected results: ", results)
+	}
+}
+
+func TestC2SStallLongerThanDataTimeout(t *testing.T) {
+	tc := newCustomTestClient(t, func(s *Session) {
+		s.config.DataTimeout = 100 * time.Millisecond
+		s.config.TestDuration = time.Second
+	})
+	defer tc.conn.Close()
+	tc.login("2")
+	conn := tc.dialData()
+	defer conn.Close()
+	tc.expect(protocol.MsgTestStart)
+	buf := make([]byte, 8192)
+	if _, err := conn.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	// The server read blocks for longer than DataTimeout, which should
+	// only be bound by the session deadline during the transfer.
+	time.Sleep(300 * time.Millisecond)
+	if _, err := conn.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	tc.expect(protocol.MsgTest)
+	tc.expect(protocol.MsgTestFinalize)
+	results := tc.logout()
+	if !strings.Contains(results, "C2STotalRecvByte: 16384") {
+		t.Error("unexpected results: ", results)
+	}
+}
@@ -0,0 +1,284 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/m-lab/ndt-server-go/netx"
+	"github.com/m-lab/ndt-server-go/protocol"
+)
+
+// Config contains the settings used when serving NDT sessions.
+type Config struct {
+	// ControlAddress is the address where we accept control connections.
+	ControlAddress string
+
+	// DataPortMin and DataPortMax are the range of ports used for the data
+	// connections. When both are zero, we use ephemeral ports.
+	DataPortMin int
+	DataPortMax int
+
+	// ReusePort tells whether the control listeners use SO_REUSEPORT,
+	// such that a restarted server can bind the control port while the
+	// previous instance is still draining. Data listeners never use it:
+	// the kernel would balance the data connections of a session between
+	// the two instances.
+	ReusePort bool
+
+	// IPFamily is the IP family of the control listeners and the default
+	// family of the data listeners. The data listeners of a session use
+	// the family and the address of its control connection, if known.
+	IPFamily netx.Family
+
+	// ControlTimeout is the timeout of the control connection I/O.
+	ControlTimeout time.Duration
+
+	// DataTimeout is the timeout of the data connections I/O and the time
+	// we wait for clients to establish data connections.
+	DataTimeout time.Duration
+
+	// SessionTimeout is the time allowed to a session to complete once it
+	// leaves the queue, after which all its I/O fails. Zero means that
+	// there is no limit.
+	SessionTimeout time.Duration
+
+	// EnabledTests contains the tests that we run if requested by clients.
+	EnabledTests protocol.TestCode
+
+	// TestDuration is the duration of the throughput tests.
+	TestDuration time.Duration
+
+	// MidDuration is the duration of the middlebox test.
+	MidDuration time.Duration
+
+	// SFWTimeout is the time allowed to each direction of the simple
+	// firewall test to complete.
+	SFWTimeout time.Duration
+
+	// MaxStreams is the maximum number of streams of the extended tests.
+	MaxStreams int
+
+	// MaxActiveSessions is the maximum number of sessions running
+	// concurrently. Zero means that there is no limit.
+	MaxActiveSessions int
+
+	// MaxQueuedSessions is the maximum number of sessions waiting in
+	// queue when MaxActiveSessions sessions are running.
+	MaxQueuedSessions int
+
+	// QueueHeartbeatInterval is the interval between two subsequent
+	// updates sent to the clients waiting in queue.
+	QueueHeartbeatInterval time.Duration
+
+	// DrainTimeout is the time we allow running sessions to complete when
+	// the server is shutting down.
+	DrainTimeout time.Duration
+
+	// OutputDir is the directory where results are saved. When empty,
+	// results are not saved.
+	OutputDir string
+
+	// OutputMaxSize is the size in bytes after which a new results file
+	// is started. Zero means no limit.
+	OutputMaxSize int64
+
+	// OutputMaxAge is the time after which a new results file is started.
+	// Zero means no limit.
+	OutputMaxAge time.Duration
+
+	// OutputCompress indicates whether results files are gzip compressed.
+	OutputCompress bool
+
+	// TCPInfoInterval is the interval at which TCP_INFO is sampled during
+	// the download tests. Zero means that TCP_INFO is not sampled.
+	TCPInfoInterval time.Duration
+
+	// S2CCongestion is the congestion control algorithm used by the data
+	// connections of the download tests (e.g. "bbr"). When empty, we use
+	// the system default.
+	S2CCongestion string
+
+	// DiagInterval is the interval at which the state of the data
+	// connections is collected using sock_diag. Zero means that we do not
+	// use sock_diag. Only supported on Linux.
+	DiagInterval time.Duration
+
+	// MaxEgressRate is the maximum aggregate rate in bit/s at which the
+	// data connections of all the sessions send data. Zero means that
+	// there is no limit.
+	MaxEgressRate int64
+
+	// TrustedProxies contains the CIDRs of the proxies, e.g. L4 load
+	// balancers, that send a PROXY protocol header with the address of
+	// the client. It applies to both control and data connections.
+	TrustedProxies []string
+}
+
+const (
+	// DefaultControlAddress is the default address of the control listener.
+	DefaultControlAddress = "localhost:3001"
+
+	// DefaultTestDuration is the default duration of the throughput tests.
+	DefaultTestDuration = 10 * time.Second
+
+	// DefaultOutputMaxSize is the default size after which a new results
+	// file is started.
+	DefaultOutputMaxSize = 64 << 20
+
+	// DefaultOutputMaxAge is the default time after which a new results
+	// file is started.
+	DefaultOutputMaxAge = time.Hour
+
+	// DefaultTCPInfoInterval is the default interval at which TCP_INFO is
+	// sampled during the download tests.
+	DefaultTCPInfoInterval = 100 * time.Millisecond
+)
+
+// maxCongestionName is the maximum length of a congestion control name.
+const maxCongestionName = 15
+
+// AllTests contains all the tests that we implement.
+const AllTests = protocol.TestMid | protocol.TestSFW | protocol.TestC2S |
+	protocol.TestC2SExt | protocol.TestS2C | protocol.TestS2CExt |
+	protocol.TestMeta
+
+// DefaultConfig returns the default configuration.
+func DefaultConfig() Config {
+	return Config{
+		ControlAddress: DefaultControlAddress,
+		ControlTimeout: netx.DefaultTimeout,
+		DataTimeout:    netx.DefaultTimeout,
+		EnabledTests:   AllTests,
+		TestDuration:   DefaultTestDuration,
+		MidDuration:    DefaultMidDuration,
+		SFWTimeout:     DefaultSFWTimeout,
+		MaxStreams:     DefaultMaxStreams,
+
+		MaxQueuedSessions:      DefaultMaxQueuedSessions,
+		QueueHeartbeatInterval: DefaultQueueHeartbeatInterval,
+		DrainTimeout:           DefaultDrainTimeout,
+
+		OutputMaxSize:  DefaultOutputMaxSize,
+		OutputMaxAge:   DefaultOutputMaxAge,
+		OutputCompress: true,
+
+		TCPInfoInterval: DefaultTCPInfoInterval,
+	}
+}
+
+// testNames maps the name of each test onto its code.
+var testNames = map[string]protocol.TestCode{
+	"mid":     protocol.TestMid,
+	"sfw":     protocol.TestSFW,
+	"c2s":     protocol.TestC2S,
+	"c2s-ext": protocol.TestC2SExt,
+	"s2c":     protocol.TestS2C,
+	"s2c-ext": protocol.TestS2CExt,
+	"meta":    protocol.TestMeta,
+}
+
+// ParseTests parses a comma separated list of test names (e.g. "c2s,s2c")
+// into the corresponding tests bitmask.
+func ParseTests(s string) (protocol.TestCode, error) {
+	var tests protocol.TestCode
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		code, ok := testNames[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown test: %q", name)
+		}
+		tests |= code
+	}
+	return tests, nil
+}
+
+// FormatTests formats |tests| as a sorted, comma separated list of names.
+func FormatTests(tests protocol.TestCode) string {
+	var names []string
+	for name, code := range testNames {
+		if tests&code != 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// Validate returns an error if the configuration is not valid.
+func (c Config) Validate() error {
+	if _, _, err := net.SplitHostPort(c.ControlAddress); err != nil {
+		return fmt.Errorf("invalid control address: %s", err)
+	}
+	if c.DataPortMin != 0 || c.DataPortMax != 0 {
+		if c.DataPortMin <= 0 || c.DataPortMax > 65535 ||
+			c.DataPortMin > c.DataPortMax {
+			return fmt.Errorf("invalid data port range: %d-%d",
+				c.DataPortMin, c.DataPortMax)
+		}
+	}
+	durations := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"control timeout", c.ControlTimeout},
+		{"data timeout", c.DataTimeout},
+		{"test duration", c.TestDuration},
+		{"middlebox test duration", c.MidDuration},
+		{"simple firewall test timeout", c.SFWTimeout},
+		{"queue heartbeat interval", c.QueueHeartbeatInterval},
+		{"drain timeout", c.DrainTimeout},
+	}
+	for _, d := range durations {
+		if d.value <= 0 {
+			return fmt.Errorf("%s must be positive: %s", d.name, d.value)
+		}
+	}
+	if c.EnabledTests&^AllTests != 0 {
+		return fmt.Errorf("unknown tests in the enabled tests: %d", c.EnabledTests)
+	}
+	if c.MaxStreams <= 0 {
+		return errors.New("the maximum number of streams must be positive")
+	}
+	if c.MaxActiveSessions < 0 || c.MaxQueuedSessions < 0 {
+		return errors.New("the maximum number of sessions cannot be negative")
+	}
+	if c.OutputDir != "" {
+		info, err := os.Stat(c.OutputDir)
+		if err == nil && !info.IsDir() {
+			return fmt.Errorf("output dir is not a directory: %s", c.OutputDir)
+		}
+	}
+	if c.OutputMaxSize < 0 || c.OutputMaxAge < 0 {
+		return errors.New("the output rotation limits cannot be negative")
+	}
+	if len(c.S2CCongestion) > maxCongestionName {
+		return fmt.Errorf("invalid congestion control: %q", c.S2CCongestion)
+	}
+	if c.TCPInfoInterval < 0 || c.DiagInterval < 0 {
+		return errors.New("the sampling intervals cannot be negative")
+	}
+	if c.SessionTimeout < 0 {
+		return errors.New("the session timeout cannot be negative")
+	}
+	if c.MaxEgressRate < 0 {
+		return errors.New("the maximum egress rate cannot be negative")
+	}
+	if c.IPFamily < netx.DualStack || c.IPFamily > netx.IPv6 {
+		return fmt.Errorf("invalid IP family: %d", c.IPFamily)
+	}
+	if _, err := netx.ParseCIDRs(c.TrustedProxies); err != nil {
+		return fmt.Errorf("invalid trusted proxies: %s", err)
+	}
+	return nil
+}
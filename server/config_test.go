@@ -0,0 +1,90 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/m-lab/ndt-server-go/netx"
+	"github.com/m-lab/ndt-server-go/protocol"
+)
+
+func TestParseTests(t *testing.T) {
+	tests, err := ParseTests(" s2c, c2s-ext,,meta ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tests != protocol.TestS2C|protocol.TestC2SExt|protocol.TestMeta {
+		t.Error("unexpected tests: ", tests)
+	}
+	if FormatTests(tests) != "c2s-ext,meta,s2c" {
+		t.Error("unexpected formatted tests: ", FormatTests(tests))
+	}
+	tests, err = ParseTests(FormatTests(AllTests))
+	if err != nil || tests != AllTests {
+		t.Error("cannot round trip all tests: ", tests, err)
+	}
+	_, err = ParseTests("s2c,status")
+	if err == nil {
+		t.Error("expected an error for an unknown test")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Fatal("the default config should be valid: ", err)
+	}
+	file, err := ioutil.TempFile("", "ndt-server-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+	for _, mutate := range []func(*Config){
+		func(c *Config) { c.ControlAddress = "localhost" },
+		func(c *Config) { c.DataPortMin = 1000 },
+		func(c *Config) { c.DataPortMin, c.DataPortMax = 2000, 1000 },
+		func(c *Config) { c.DataPortMin, c.DataPortMax = 1000, 70000 },
+		func(c *Config) { c.ControlTimeout = 0 },
+		func(c *Config) { c.DataTimeout = -1 },
+		func(c *Config) { c.TestDuration = 0 },
+		func(c *Config) { c.MidDuration = 0 },
+		func(c *Config) { c.SFWTimeout = 0 },
+		func(c *Config) { c.QueueHeartbeatInterval = 0 },
+		func(c *Config) { c.DrainTimeout = 0 },
+		func(c *Config) { c.EnabledTests = protocol.TestStatus },
+		func(c *Config) { c.MaxStreams = 0 },
+		func(c *Config) { c.MaxActiveSessions = -1 },
+		func(c *Config) { c.MaxQueuedSessions = -1 },
+		func(c *Config) { c.OutputDir = file.Name() },
+		func(c *Config) { c.OutputMaxSize = -1 },
+		func(c *Config) { c.TCPInfoInterval = -1 },
+		func(c *Config) { c.DiagInterval = -1 },
+		func(c *Config) { c.SessionTimeout = -1 },
+		func(c *Config) { c.MaxEgressRate = -1 },
+		func(c *Config) { c.TrustedProxies = []string{"10.0.0.0/40"} },
+		func(c *Config) { c.IPFamily = netx.IPv6 + 1 },
+		func(c *Config) { c.S2CCongestion = "no-such-congestion-control" },
+	} {
+		config := DefaultConfig()
+		mutate(&config)
+		if config.Validate() == nil {
+			t.Errorf("expected an error for: %+v", config)
+		}
+	}
+}
+
+func TestSessionSkipsDisabledTests(t *testing.T) {
+	tc := newCustomTestClient(t, func(s *Session) {
+		s.config.EnabledTests = protocol.TestMeta
+	})
+	defer tc.conn.Close()
+	if suite := tc.login("54"); suite != "32" {
+		t.Fatal("unexpected tests suite: ", suite)
+	}
+	tc.runMeta(nil)
+	tc.logout()
+}
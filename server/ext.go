@@ -0,0 +1,278 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m-lab/ndt-server-go/protocol"
+	"github.com/m-lab/ndt-server-go/tcpinfo"
+)
+
+// DefaultMaxStreams is the default maximum number of parallel streams
+// that a client may request in the extended tests.
+const DefaultMaxStreams = 8
+
+// ErrInvalidExtParams is returned when the client requests invalid
+// parameters for an extended test.
+var ErrInvalidExtParams = errors.New("Invalid extended test parameters")
+
+// extParams contains the parameters of an extended test.
+type extParams struct {
+	streams  int
+	duration time.Duration
+}
+
+// prepareExt announces the data |port| and the maximum parameters of the
+// extended test using MsgTestPrepare. The payload is "port duration
+// snapshots delay offset streams", where the duration is in milliseconds
+// and snapshots are not supported. Then, it reads the MsgTestPrepare with
+// which the client requests "streams duration", clamps the values to the
+// announced maximum and returns them.
+func (s *Session) prepareExt(port int) (extParams, error) {
+	max := extParams{s.config.MaxStreams, s.config.TestDuration}
+	err := s.sendMsg(protocol.MsgTestPrepare, fmt.Sprintf("%d %d 0 0 0 %d",
+		port, max.duration/time.Millisecond, max.streams))
+	if err != nil {
+		return extParams{}, err
+	}
+	msg, err := s.readMsg(protocol.MsgTestPrepare)
+	if err != nil {
+		return extParams{}, err
+	}
+	fields := strings.Fields(msg)
+	if len(fields) != 2 {
+		return extParams{}, ErrInvalidExtParams
+	}
+	streams, err := strconv.Atoi(fields[0])
+	if err != nil || streams <= 0 {
+		return extParams{}, ErrInvalidExtParams
+	}
+	millis, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || millis <= 0 {
+		return extParams{}, ErrInvalidExtParams
+	}
+	params := extParams{streams, time.Duration(millis) * time.Millisecond}
+	if params.streams > max.streams {
+		params.streams = max.streams
+	}
+	if params.duration > max.duration {
+		params.duration = max.duration
+	}
+	return params, nil
+}
+
+// acceptStreams accepts |count| data connections using |ln|.
+func (s *Session) acceptStreams(ln net.Listener, count int) ([]*net.TCPConn, error) {
+	var conns []*net.TCPConn
+	for i := 0; i < count; i++ {
+		conn, _, err := s.accept(ln)
+		if err != nil {
+			closeStreams(conns)
+			return nil, err
+		}
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+// closeStreams closes all the |conns|.
+func closeStreams(conns []*net.TCPConn) {
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// streamResult contains the measurements of a single stream.
+type streamResult struct {
+	count   int64
+	elapsed time.Duration
+	info    *tcpinfo.TCPInfo
+	unsent  uint64
+	samples []tcpinfo.Sample
+	cc      *tcpinfo.CCInfo
+	err     error
+}
+
+// transferFunc transfers data on a connection for the specified duration.
+type transferFunc func(net.Conn, time.Duration) (int64, time.Duration, error)
+
+// runStreams runs |transfer| in parallel on each of |conns| for |duration|,
+// reads TCP_INFO when the transfer is over and closes the connection. When
+// |download| is true, the connections use the configured S2C congestion
+// control, TCP_INFO is also sampled during the transfer and TCP_CC_INFO is
+// read when the transfer is over.
+func (s *Session) runStreams(conns []*net.TCPConn, duration time.Duration,
+	transfer transferFunc, download bool) []streamResult {
+	results := make([]streamResult, len(conns))
+	var wg sync.WaitGroup
+	for i, conn := range conns {
+		wg.Add(1)
+		go func(r *streamResult, conn *net.TCPConn) {
+			defer wg.Done()
+			defer conn.Close()
+			var sampler *tcpinfo.Sampler
+			if download {
+				s.setCongestion(conn)
+				sampler = s.startSampler(conn)
+			}
+			r.count, r.elapsed, r.err = transfer(s.bulkConn(conn), duration)
+			r.samples = stopSampler(sampler)
+			if download {
+				r.cc = readCongestionInfo(conn)
+			}
+			info, err := tcpinfo.TCPInfo2(conn)
+			if err != nil {
+				log.Println("Cannot read TCP_INFO:", err)
+				return
+			}
+			r.info = info
+			if download {
+				r.unsent = unsentData(conn, info)
+			}
+		}(&results[i], conn)
+	}
+	wg.Wait()
+	return results
+}
+
+// aggregate returns the total bytes transferred by all the |streams|, the
+// longest transfer time, and the first error that occurred, if any.
+func aggregate(streams []streamResult) (int64, time.Duration, error) {
+	var total int64
+	var elapsed time.Duration
+	for _, r := range streams {
+		if r.err != nil {
+			return 0, 0, r.err
+		}
+		total += r.count
+		if r.elapsed > elapsed {
+			elapsed = r.elapsed
+		}
+	}
+	return total, elapsed, nil
+}
+
+// addStreamResults adds the per-stream results using |prefix|.
+func (s *Session) addStreamResults(prefix string, streams []streamResult) {
+	s.addResult(prefix+"Streams", len(streams))
+	for i, r := range streams {
+		name := fmt.Sprintf("%sStream%d.", prefix, i)
+		s.addResult(name+"Throughput", kbps(r.count, r.elapsed))
+		s.addResult(name+"TotalByte", r.count)
+		s.addSamples(i, r.samples)
+		if r.info == nil {
+			continue
+		}
+		s.addSnapshot(i, r.info, r.cc)
+		for _, v := range web100Vars(r.info) {
+			s.addResult(name+v.name, v.value)
+		}
+	}
+}
+
+// startExt prepares an extended test, accepts the data connections and
+// starts the test. Returns the data connections and the negotiated test
+// duration.
+func (s *Session) startExt() ([]*net.TCPConn, time.Duration, error) {
+	ln, port, err := s.listenData()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer ln.Close()
+	params, err := s.prepareExt(port)
+	if err != nil {
+		return nil, 0, err
+	}
+	conns, err := s.acceptStreams(ln, params.streams)
+	if err != nil {
+		return nil, 0, err
+	}
+	err = s.sendMsg(protocol.MsgTestStart, "")
+	if err != nil {
+		closeStreams(conns)
+		return nil, 0, err
+	}
+	return conns, params.duration, nil
+}
+
+// runC2SExt runs the multi-stream upload test.
+func runC2SExt(s *Session) error {
+	conns, duration, err := s.startExt()
+	if err != nil {
+		return err
+	}
+	streams := s.runStreams(conns, duration, recvData, false)
+	total, elapsed, err := aggregate(streams)
+	if err != nil {
+		return err
+	}
+	throughput := kbps(total, elapsed)
+	err = s.sendMsg(protocol.MsgTest, fmt.Sprintf("%.0f", throughput))
+	if err != nil {
+		return err
+	}
+	s.addResult("C2SExtThroughput", throughput)
+	s.addResult("C2SExtTotalRecvByte", total)
+	s.addStreamResults("C2SExt", streams)
+	return s.sendMsg(protocol.MsgTestFinalize, "")
+}
+
+// runS2CExt runs the multi-stream download test.
+func runS2CExt(s *Session) error {
+	conns, duration, err := s.startExt()
+	if err != nil {
+		return err
+	}
+	streams := s.runStreams(conns, duration, sendData, true)
+	total, elapsed, err := aggregate(streams)
+	if err != nil {
+		return err
+	}
+	var unsent uint64
+	for _, r := range streams {
+		unsent += r.unsent
+	}
+	throughput := kbps(total, elapsed)
+	err = s.ctrl.SendJSON(protocol.MsgTest, s2cResultMsg{
+		ThroughputValue:  fmt.Sprintf("%.0f", throughput),
+		UnsentDataAmount: strconv.FormatUint(unsent, 10),
+		TotalSentByte:    strconv.FormatInt(total, 10),
+	})
+	if err != nil {
+		return err
+	}
+	clientThroughput, err := s.readMsg(protocol.MsgTest)
+	if err != nil {
+		return err
+	}
+	clientValue, err := strconv.ParseFloat(clientThroughput, 64)
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	for i, r := range streams {
+		lines = append(lines, fmt.Sprintf("Stream%d.Throughput: %.0f\n", i,
+			kbps(r.count, r.elapsed)))
+	}
+	err = s.sendLines(protocol.MsgTest, lines)
+	if err != nil {
+		return err
+	}
+
+	s.addResult("S2CExtServerThroughput", throughput)
+	s.addResult("S2CExtClientThroughput", clientValue)
+	s.addResult("S2CExtTotalSentByte", total)
+	s.addResult("S2CExtUnsentDataAmount", unsent)
+	s.addStreamResults("S2CExt", streams)
+	return s.sendMsg(protocol.MsgTestFinalize, "")
+}
@@ -0,0 +1,143 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server-go/protocol"
+)
+
+// dialStreams reads the extended MsgTestPrepare, requests |streams| streams
+// lasting |duration| and connects them.
+func (tc *testClient) dialStreams(streams int, duration time.Duration) []net.Conn {
+	fields := strings.Fields(tc.expect(protocol.MsgTestPrepare))
+	if len(fields) != 6 {
+		tc.t.Fatal("unexpected prepare message: ", fields)
+	}
+	max, err := strconv.Atoi(fields[5])
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	if streams > max {
+		streams = max
+	}
+	tc.send(protocol.MsgTestPrepare, fmt.Sprintf("%d %d", streams,
+		duration/time.Millisecond))
+	var conns []net.Conn
+	for i := 0; i < streams; i++ {
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", fields[0]))
+		if err != nil {
+			tc.t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+	tc.expect(protocol.MsgTestStart)
+	return conns
+}
+
+func TestS2CExt(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.conn.Close()
+	suite := tc.login("144")
+	if suite != "128" {
+		t.Fatal("unexpected tests suite: ", suite)
+	}
+	conns := tc.dialStreams(4, 100*time.Millisecond)
+	var wg sync.WaitGroup
+	var total int64
+	var mu sync.Mutex
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn net.Conn) {
+			defer wg.Done()
+			defer conn.Close()
+			count, _ := io.Copy(ioutil.Discard, conn)
+			mu.Lock()
+			total += count
+			mu.Unlock()
+		}(conn)
+	}
+	wg.Wait()
+	var msg s2cResultMsg
+	err := json.Unmarshal(tc.expectRaw(protocol.MsgTest), &msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.TotalSentByte != strconv.FormatInt(total, 10) {
+		t.Error("unexpected total bytes: ", msg.TotalSentByte, total)
+	}
+	tc.send(protocol.MsgTest, "1234")
+	lines := tc.readTestMsgs()
+	if strings.Count(lines, "Throughput: ") != 4 {
+		t.Error("unexpected per-stream throughput: ", lines)
+	}
+	results := tc.logout()
+	if !strings.Contains(results, "S2CExtStreams: 4\n") ||
+		!strings.Contains(results, "S2CExtStream3.CurMSS: ") {
+		t.Error("unexpected results: ", results)
+	}
+}
+
+func TestC2SExt(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.conn.Close()
+	suite := tc.login("80")
+	if suite != "64" {
+		t.Fatal("unexpected tests suite: ", suite)
+	}
+	// Request more streams than allowed to check that we are clamped
+	conns := tc.dialStreams(2*DefaultMaxStreams, time.Minute)
+	if len(conns) != DefaultMaxStreams {
+		t.Fatal("unexpected number of streams: ", len(conns))
+	}
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn net.Conn) {
+			defer wg.Done()
+			defer conn.Close()
+			buf := make([]byte, 8192)
+			for {
+				_, err := conn.Write(buf)
+				if err != nil {
+					return
+				}
+			}
+		}(conn)
+	}
+	throughput, err := strconv.ParseFloat(tc.expect(protocol.MsgTest), 64)
+	if err != nil || throughput <= 0 {
+		t.Error("unexpected throughput: ", throughput, err)
+	}
+	tc.expect(protocol.MsgTestFinalize)
+	wg.Wait()
+	results := tc.logout()
+	if !strings.Contains(results, fmt.Sprintf("C2SExtStreams: %d\n", DefaultMaxStreams)) {
+		t.Error("unexpected results: ", results)
+	}
+}
+
+func TestExtInvalidParams(t *testing.T) {
+	for _, params := range []string{"", "1", "0 100", "1 -1", "x 100", "1 100 1"} {
+		tc := newTestClient(t)
+		tc.login("144")
+		tc.expect(protocol.MsgTestPrepare)
+		tc.send(protocol.MsgTestPrepare, params)
+		_, err := protocol.ReadMessage(tc.rdwr.Reader)
+		if err == nil {
+			t.Error("the server should have closed the connection: ", params)
+		}
+		tc.conn.Close()
+	}
+}
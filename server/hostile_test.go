@@ -0,0 +1,97 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package server
+
+import (
+	"bufio"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server-go/netx/netxtest"
+	"github.com/m-lab/ndt-server-go/protocol"
+)
+
+// newHostileTestClient is like newCustomTestClient but the client injects
+// |faults| in the I/O of the control connection.
+func newHostileTestClient(t *testing.T, setup func(*Session),
+	faults ...netxtest.Fault) *testClient {
+	tc := newCustomTestClient(t, setup)
+	tc.conn = netxtest.NewConn(tc.conn, 0, faults...)
+	tc.rdwr = bufio.NewReadWriter(bufio.NewReader(tc.conn),
+		bufio.NewWriter(tc.conn))
+	return tc
+}
+
+// waitSession waits for the session of |tc| to end and fails if it takes
+// longer than |timeout|.
+func (tc *testClient) waitSession(timeout time.Duration) {
+	select {
+	case <-tc.done:
+	case <-time.After(timeout):
+		tc.t.Fatal("the session did not end in ", timeout)
+	}
+}
+
+func TestSessionOverFragmentingNetwork(t *testing.T) {
+	tc := newHostileTestClient(t, nil,
+		netxtest.Fault{Kind: netxtest.ShortIO, Dir: netxtest.Write, Size: 1},
+		netxtest.Fault{Kind: netxtest.ShortIO, Dir: netxtest.Read, Size: 3},
+		netxtest.Fault{Kind: netxtest.Latency, Dir: netxtest.Both,
+			Jitter: time.Millisecond})
+	defer tc.conn.Close()
+	suite := tc.login("20") // TestS2C | TestStatus
+	if suite != "4" {
+		t.Fatal("unexpected tests suite: ", suite)
+	}
+	count, _ := tc.runS2C()
+	if count <= 0 {
+		t.Error("no data received")
+	}
+	tc.send(protocol.MsgTest, "1234")
+	tc.readTestMsgs()
+	results := tc.logout()
+	if results == "" {
+		t.Error("missing results")
+	}
+	tc.waitSession(time.Second)
+}
+
+func TestSessionClientResetDuringLogin(t *testing.T) {
+	tc := newHostileTestClient(t, nil, netxtest.Fault{
+		Kind: netxtest.Reset, Dir: netxtest.Write, Offset: 5,
+	})
+	defer tc.conn.Close()
+	err := protocol.Send(tc.rdwr.Writer, protocol.MsgExtendedLogin,
+		[]byte(`{"msg": "v3.7.0", "tests": "16"}`))
+	if err != netxtest.ErrReset {
+		t.Fatal("expected a reset, got: ", err)
+	}
+	tc.waitSession(time.Second)
+}
+
+func TestSessionClientStallsDuringLogin(t *testing.T) {
+	tc := newHostileTestClient(t, func(s *Session) {
+		s.dc.SetTimeout(100 * time.Millisecond)
+	}, netxtest.Fault{
+		Kind: netxtest.Stall, Dir: netxtest.Write, Offset: 5,
+	})
+	defer tc.conn.Close()
+	go protocol.Send(tc.rdwr.Writer, protocol.MsgExtendedLogin,
+		[]byte(`{"msg": "v3.7.0", "tests": "16"}`))
+	// Well before the default control timeout
+	tc.waitSession(time.Second)
+}
+
+func TestSessionCorruptedLogin(t *testing.T) {
+	tc := newHostileTestClient(t, nil, netxtest.Fault{
+		Kind: netxtest.Corrupt, Dir: netxtest.Write, Offset: 0, Mask: 0xff,
+	})
+	defer tc.conn.Close()
+	err := protocol.Send(tc.rdwr.Writer, protocol.MsgExtendedLogin,
+		[]byte(`{"msg": "v3.7.0", "tests": "16"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.waitSession(time.Second)
+}
@@ -0,0 +1,93 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package server
+
+import (
+	"errors"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/m-lab/ndt-server-go/protocol"
+)
+
+const (
+	// metaMaxKeyLength is the maximum length of a metadata key.
+	metaMaxKeyLength = 64
+
+	// metaMaxValueLength is the maximum length of a metadata value.
+	metaMaxValueLength = 256
+
+	// metaMaxEntries is the maximum number of metadata entries we keep.
+	metaMaxEntries = 32
+
+	// metaMaxMessages is the maximum number of metadata messages we read,
+	// including the invalid and the discarded ones.
+	metaMaxMessages = 2 * metaMaxEntries
+)
+
+// ErrTooManyMetaMsgs is returned when the client sends more than
+// metaMaxMessages messages during the metadata test.
+var ErrTooManyMetaMsgs = errors.New("Too many metadata test messages")
+
+// metaKeyRegexp matches the valid metadata keys, e.g. "client.os.name".
+var metaKeyRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// parseMeta parses a "key:value" metadata message. Returns false if the
+// message is malformed or the key or the value are not valid.
+func parseMeta(msg string) (string, string, bool) {
+	idx := strings.Index(msg, ":")
+	if idx < 0 {
+		return "", "", false
+	}
+	key, value := msg[:idx], msg[idx+1:]
+	if len(key) > metaMaxKeyLength || !metaKeyRegexp.MatchString(key) {
+		return "", "", false
+	}
+	if len(value) > metaMaxValueLength {
+		return "", "", false
+	}
+	return key, value, true
+}
+
+// runMeta runs the metadata test. After MsgTestPrepare and MsgTestStart, the
+// client sends "key:value" MsgTest messages, terminated by an empty message.
+// We discard invalid entries and the entries exceeding metaMaxEntries, and
+// fail if the client sends more than metaMaxMessages entries.
+func runMeta(s *Session) error {
+	err := s.sendMsg(protocol.MsgTestPrepare, "")
+	if err != nil {
+		return err
+	}
+	err = s.sendMsg(protocol.MsgTestStart, "")
+	if err != nil {
+		return err
+	}
+	if s.metadata == nil {
+		s.metadata = make(map[string]string)
+	}
+	for count := 0; ; count++ {
+		msg, err := s.readMsg(protocol.MsgTest)
+		if err != nil {
+			return err
+		}
+		if msg == "" {
+			break
+		}
+		if count >= metaMaxMessages {
+			return ErrTooManyMetaMsgs
+		}
+		key, value, ok := parseMeta(msg)
+		if !ok {
+			log.Printf("Meta: discarding invalid entry: %q\n", msg)
+			continue
+		}
+		if _, found := s.metadata[key]; !found && len(s.metadata) >= metaMaxEntries {
+			log.Printf("Meta: discarding entry exceeding limit: %q\n", key)
+			continue
+		}
+		s.metadata[key] = value
+	}
+	return s.sendMsg(protocol.MsgTestFinalize, "")
+}
@@ -0,0 +1,89 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server-go/protocol"
+)
+
+// runMeta runs the client side of the metadata test sending |entries|.
+func (tc *testClient) runMeta(entries []string) {
+	tc.expect(protocol.MsgTestPrepare)
+	tc.expect(protocol.MsgTestStart)
+	for _, entry := range entries {
+		tc.send(protocol.MsgTest, entry)
+	}
+	tc.send(protocol.MsgTest, "")
+	tc.expect(protocol.MsgTestFinalize)
+}
+
+func TestMeta(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.conn.Close()
+	suite := tc.login("48")
+	if suite != "32" {
+		t.Fatal("unexpected tests suite: ", suite)
+	}
+	tc.runMeta([]string{
+		"client.os.name:Linux",
+		"client.browser.name:Firefox: Quantum",
+		"client.version:",
+		"client.application:" + strings.Repeat("x", metaMaxValueLength+1),
+		strings.Repeat("k", metaMaxKeyLength+1) + ":value",
+		"client version:1.0",
+		"no separator",
+	})
+	tc.logout()
+	s := <-tc.done
+	expect := map[string]string{
+		"client.os.name":      "Linux",
+		"client.browser.name": "Firefox: Quantum",
+		"client.version":      "",
+	}
+	if len(s.metadata) != len(expect) {
+		t.Fatal("unexpected metadata: ", s.metadata)
+	}
+	for key, value := range expect {
+		if s.metadata[key] != value {
+			t.Error("unexpected value for ", key, ": ", s.metadata[key])
+		}
+	}
+}
+
+func TestMetaMaxEntries(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.conn.Close()
+	tc.legacy = true
+	tc.login("48")
+	var entries []string
+	for i := 0; i < 2*metaMaxEntries; i++ {
+		entries = append(entries, fmt.Sprintf("key%d:value", i))
+	}
+	tc.runMeta(entries)
+	tc.logout()
+	s := <-tc.done
+	if len(s.metadata) != metaMaxEntries {
+		t.Error("unexpected number of entries: ", len(s.metadata))
+	}
+}
+
+func TestMetaTooManyMessages(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.conn.Close()
+	tc.login("48")
+	tc.expect(protocol.MsgTestPrepare)
+	tc.expect(protocol.MsgTestStart)
+	for i := 0; i <= metaMaxMessages; i++ {
+		tc.send(protocol.MsgTest, "no separator")
+	}
+	tc.waitSession(time.Second)
+	if _, err := tc.rdwr.ReadByte(); err == nil {
+		t.Error("the session should have ended")
+	}
+}
@@ -0,0 +1,131 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/m-lab/ndt-server-go/netx"
+	"github.com/m-lab/ndt-server-go/protocol"
+	"github.com/m-lab/ndt-server-go/tcpinfo"
+)
+
+const (
+	// DefaultMidDuration is the default duration of the middlebox test.
+	DefaultMidDuration = 5 * time.Second
+
+	// midMSS is the MSS we set on the IPv4 middlebox test listener. The
+	// MSS of the connection may be smaller because the client advertises
+	// a smaller one, e.g. because of PPPoE, or because a middlebox clamps
+	// it, hence we report both the expected MSS and the actual one.
+	midMSS = 1456
+
+	// midMSS6 is the MSS we set on the IPv6 middlebox test listener, which
+	// accounts for the IPv6 header being 20 bytes larger.
+	midMSS6 = midMSS - 20
+)
+
+// ErrInvalidMidMsg is returned when the client sends a malformed message
+// during the middlebox test.
+var ErrInvalidMidMsg = errors.New("Invalid middlebox test message")
+
+// sameIP returns whether the |a| and |b| "host:port" addresses refer
+// to the same IP address.
+func sameIP(a, b string) bool {
+	ha, _, err := net.SplitHostPort(a)
+	if err != nil {
+		return false
+	}
+	hb, _, err := net.SplitHostPort(b)
+	if err != nil {
+		return false
+	}
+	ipa, ipb := net.ParseIP(ha), net.ParseIP(hb)
+	return ipa != nil && ipb != nil && ipa.Equal(ipb)
+}
+
+// runMid runs the middlebox test. We set the MSS on the listener, send data
+// for a short time and then send "mss;winScaleSent;winScaleRcvd;serverAddr;
+// clientAddr;throughput" to the client, which replies with the addresses it
+// sees and its throughput as "serverAddr;clientAddr;throughput". Different
+// addresses reveal NATs and a different MSS reveals MSS clamping.
+func runMid(s *Session) error {
+	ln, port, err := s.listenData()
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	listenMSS := uint32(midMSS)
+	if netx.AddrFamily(s.localAddr()) == netx.IPv6 {
+		listenMSS = midMSS6
+	}
+	err = tcpinfo.SetMSS(ln.(*net.TCPListener), int(listenMSS))
+	if err != nil {
+		return err
+	}
+	conn, peer, err := s.acceptData(ln, port)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	total, elapsed, err := sendData(s.dataConn(conn), s.config.MidDuration)
+	if err != nil {
+		return err
+	}
+	info, err := tcpinfo.TCPInfo2(conn)
+	if err != nil {
+		log.Println("Cannot read TCP_INFO:", err)
+	}
+	s.addSnapshot(0, info, nil)
+	serverAddr := peer.LocalAddr().String()
+	clientAddr := peer.RemoteAddr().String()
+	conn.Close()
+
+	var mss, expected uint32
+	wsSent, wsRcvd := -1, -1
+	if info != nil {
+		mss = info.SndMSS
+		expected = expectedMSS(info, listenMSS)
+		wsSent, wsRcvd = winScale(info)
+	}
+	throughput := kbps(total, elapsed)
+	err = s.sendMsg(protocol.MsgTest, fmt.Sprintf("%d;%d;%d;%s;%s;%.0f",
+		mss, wsSent, wsRcvd, serverAddr, clientAddr, throughput))
+	if err != nil {
+		return err
+	}
+	msg, err := s.readMsg(protocol.MsgTest)
+	if err != nil {
+		return err
+	}
+	fields := strings.Split(msg, ";")
+	if len(fields) != 3 {
+		return ErrInvalidMidMsg
+	}
+	clientThroughput, err := strconv.ParseFloat(fields[2], 64)
+	if err != nil {
+		return ErrInvalidMidMsg
+	}
+
+	s.addResult("MidMSS", mss)
+	s.addResult("MidExpectedMSS", expected)
+	s.addResult("MidWinScaleSent", wsSent)
+	s.addResult("MidWinScaleRcvd", wsRcvd)
+	s.addResult("MidServerThroughput", throughput)
+	s.addResult("MidClientThroughput", clientThroughput)
+	s.addResult("MidServerAddr", serverAddr)
+	s.addResult("MidServerAddrSeenByClient", fields[0])
+	s.addResult("MidClientAddr", clientAddr)
+	s.addResult("MidClientAddrSeenByClient", fields[1])
+	s.addResult("MidServerNAT", !sameIP(serverAddr, fields[0]))
+	s.addResult("MidClientNAT", !sameIP(clientAddr, fields[1]))
+	return s.sendMsg(protocol.MsgTestFinalize, "")
+}
@@ -0,0 +1,122 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/m-lab/ndt-server-go/protocol"
+)
+
+// runMid runs the client side of the middlebox test and replies with
+// |serverAddr| and |clientAddr|, or with the addresses it sees, if empty.
+func (tc *testClient) runMid(serverAddr, clientAddr string) []string {
+	conn := tc.dialData()
+	defer conn.Close()
+	_, err := io.Copy(ioutil.Discard, conn)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	fields := strings.Split(tc.expect(protocol.MsgTest), ";")
+	if len(fields) != 6 {
+		tc.t.Fatal("unexpected middlebox message: ", fields)
+	}
+	if serverAddr == "" {
+		serverAddr = conn.RemoteAddr().String()
+	}
+	if clientAddr == "" {
+		clientAddr = conn.LocalAddr().String()
+	}
+	tc.send(protocol.MsgTest, serverAddr+";"+clientAddr+";1234")
+	tc.expect(protocol.MsgTestFinalize)
+	return fields
+}
+
+func TestMid(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.conn.Close()
+	suite := tc.login("17")
+	if suite != "1" {
+		t.Fatal("unexpected tests suite: ", suite)
+	}
+	fields := tc.runMid("", "")
+	// The MSS is 12 bytes smaller when the timestamps option is used
+	if fields[0] != "1456" && fields[0] != "1444" {
+		t.Error("unexpected MSS: ", fields[0])
+	}
+	results := tc.logout()
+	for _, s := range []string{
+		"MidExpectedMSS: " + fields[0] + "\n",
+		"MidClientThroughput: 1234.00\n",
+		"MidServerNAT: false\n",
+		"MidClientNAT: false\n",
+	} {
+		if !strings.Contains(results, s) {
+			t.Error("missing ", s, " in results: ", results)
+		}
+	}
+}
+
+func TestMidOverIPv6(t *testing.T) {
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 is not available: ", err)
+	}
+	ln.Close()
+	tc := newTestClientOn(t, "[::1]:0", nil)
+	defer tc.conn.Close()
+	tc.login("17") // TestMid | TestStatus
+	fields := tc.runMid("", "")
+	// The IPv6 header is 20 bytes larger than the IPv4 one
+	if fields[0] != "1436" && fields[0] != "1424" {
+		t.Error("unexpected MSS: ", fields[0])
+	}
+	results := tc.logout()
+	if !strings.Contains(results, "MidExpectedMSS: "+fields[0]+"\n") {
+		t.Error("unexpected results: ", results)
+	}
+}
+
+func TestMidDetectsNAT(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.conn.Close()
+	tc.legacy = true
+	tc.login("17")
+	tc.runMid("", "10.0.0.1:5555")
+	results := tc.logout()
+	if !strings.Contains(results, "MidClientNAT: true\n") {
+		t.Error("NAT not detected: ", results)
+	}
+}
+
+func TestMidInvalidReply(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.conn.Close()
+	tc.login("17")
+	conn := tc.dialData()
+	defer conn.Close()
+	io.Copy(ioutil.Discard, conn)
+	tc.expect(protocol.MsgTest)
+	tc.send(protocol.MsgTest, "1.2.3.4:80;1234")
+	_, err := protocol.ReadMessage(tc.rdwr.Reader)
+	if err == nil {
+		t.Error("the server should have closed the connection")
+	}
+}
+
+func TestSameIP(t *testing.T) {
+	if !sameIP("127.0.0.1:80", "127.0.0.1:8080") {
+		t.Error("ports should not matter")
+	}
+	if !sameIP("[::ffff:127.0.0.1]:80", "127.0.0.1:80") {
+		t.Error("IPv4-mapped addresses should match")
+	}
+	if sameIP("127.0.0.1:80", "10.0.0.1:80") || sameIP("127.0.0.1", "127.0.0.1") {
+		t.Error("unexpected match")
+	}
+}
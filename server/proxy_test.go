@@ -0,0 +1,124 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package server
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/m-lab/ndt-server-go/protocol"
+)
+
+// sendProxyHeader sends a PROXY protocol v1 header on |conn| claiming
+// that it comes from |source| and was sent to |dest|.
+func sendProxyHeader(t *testing.T, conn net.Conn, source, dest string) {
+	src, dst := strings.Split(source, ":"), strings.Split(dest, ":")
+	_, err := conn.Write([]byte("PROXY TCP4 " + src[0] + " " + dst[0] + " " +
+		src[1] + " " + dst[1] + "\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerBehindProxy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ndt-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := testConfig()
+	config.OutputDir = dir
+	config.OutputCompress = false
+	config.TrustedProxies = []string{"127.0.0.0/8"}
+	srv, address, _ := startTestServer(t, config)
+
+	tc := dialTestClient(t, address)
+	defer tc.conn.Close()
+	sendProxyHeader(t, tc.conn, "192.0.2.7:4444", "192.0.2.1:3001")
+	tc.login("17") // TestMid | TestStatus
+	port := tc.expect(protocol.MsgTestPrepare)
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sendProxyHeader(t, conn, "192.0.2.7:4445", "192.0.2.1:"+port)
+	_, err = io.Copy(ioutil.Discard, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := strings.Split(tc.expect(protocol.MsgTest), ";")
+	if len(fields) != 6 || fields[3] != "192.0.2.1:"+port ||
+		fields[4] != "192.0.2.7:4445" {
+		t.Fatal("the data connection addresses are not the client's: ", fields)
+	}
+	tc.send(protocol.MsgTest, fields[3]+";"+fields[4]+";1234")
+	tc.expect(protocol.MsgTestFinalize)
+	results := tc.logout()
+	if !strings.Contains(results, "MidClientNAT: false\n") {
+		t.Error("the proxy should not look like a NAT: ", results)
+	}
+	err = srv.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := readRecords(t, dir)
+	if len(records) != 1 {
+		t.Fatal("unexpected number of records: ", len(records))
+	}
+	r := records[0]
+	if r.ClientAddr != "192.0.2.7:4444" || r.ServerAddr != "192.0.2.1:3001" {
+		t.Error("unexpected addresses: ", r.ClientAddr, r.ServerAddr)
+	}
+	if r.ProxyAddr != tc.conn.LocalAddr().String() {
+		t.Error("unexpected proxy address: ", r.ProxyAddr)
+	}
+}
+
+func TestServerRejectsMissingProxyHeader(t *testing.T) {
+	config := testConfig()
+	config.TrustedProxies = []string{"127.0.0.1"}
+	srv, address, _ := startTestServer(t, config)
+	defer srv.Shutdown(context.Background())
+	tc := dialTestClient(t, address)
+	defer tc.conn.Close()
+	err := protocol.SendJSON(tc.rdwr.Writer, protocol.MsgExtendedLogin,
+		map[string]string{"msg": "v3.7.0", "tests": "16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Depending on timing, the server closes or resets the connection
+	data, _ := ioutil.ReadAll(tc.rdwr)
+	if len(data) != 0 {
+		t.Error("the server should not reply: ", string(data))
+	}
+}
+
+func TestSFWBehindProxy(t *testing.T) {
+	config := testConfig()
+	config.TrustedProxies = []string{"127.0.0.0/8"}
+	srv, address, _ := startTestServer(t, config)
+	defer srv.Shutdown(context.Background())
+
+	tc := dialTestClient(t, address)
+	defer tc.conn.Close()
+	// The server connects to the source of the PROXY header, hence we
+	// use the loopback as the client address.
+	sendProxyHeader(t, tc.conn, "127.0.0.1:4444", "192.0.2.1:3001")
+	tc.proxySource = "127.0.0.1:4445"
+	tc.login("24") // TestSFW | TestStatus
+	if verdict := tc.runSFW(true, true); verdict != "1" {
+		t.Error("unexpected verdict: ", verdict)
+	}
+	results := tc.logout()
+	if !strings.Contains(results, "SFWClientToServer: open\n") {
+		t.Error("unexpected results: ", results)
+	}
+}
@@ -0,0 +1,230 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package server
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/m-lab/ndt-server-go/protocol"
+)
+
+const (
+	// DefaultMaxQueuedSessions is the default maximum number of sessions
+	// waiting in queue for their turn.
+	DefaultMaxQueuedSessions = 32
+
+	// DefaultQueueHeartbeatInterval is the default interval between two
+	// subsequent updates sent to clients waiting in queue.
+	DefaultQueueHeartbeatInterval = 5 * time.Second
+)
+
+// ErrServerBusy is returned when a session is rejected because the
+// server is running too many sessions.
+var ErrServerBusy = errors.New("Server is busy")
+
+// ErrServerShutdown is returned when a session waiting in queue is
+// terminated because the server is shutting down.
+var ErrServerShutdown = errors.New("Server is shutting down")
+
+// errQueueFull is returned when the queue cannot hold more sessions.
+var errQueueFull = errors.New("Queue is full")
+
+// errQueueClosed is returned when the queue has been shut down.
+var errQueueClosed = errors.New("Queue is closed")
+
+// queueTicket is the place of a session in the queue. Its |ready| channel
+// is closed when the session is allowed to run.
+type queueTicket struct {
+	ready chan struct{}
+}
+
+// queue limits the number of sessions running concurrently. Sessions
+// exceeding the limit wait for their turn in FIFO order.
+type queue struct {
+	mu         sync.Mutex
+	maxActive  int
+	maxWaiting int
+	active     int
+	waiting    []*queueTicket
+	closed     chan struct{}
+	isClosed   bool
+}
+
+// newQueue creates a queue that runs at most |maxActive| sessions and holds
+// at most |maxWaiting| waiting sessions.
+func newQueue(maxActive, maxWaiting int) *queue {
+	return &queue{
+		maxActive:  maxActive,
+		maxWaiting: maxWaiting,
+		closed:     make(chan struct{}),
+	}
+}
+
+// shutdown closes the queue. Waiting sessions are notified using the
+// |closed| channel and no more sessions can enter the queue.
+func (q *queue) shutdown() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.isClosed {
+		q.isClosed = true
+		close(q.closed)
+	}
+}
+
+// tryAcquire returns true if a session can run now, false otherwise. In the
+// former case, the caller must call release when the session is done.
+func (q *queue) tryAcquire() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.active >= q.maxActive || len(q.waiting) > 0 {
+		return false
+	}
+	q.active++
+	return true
+}
+
+// enqueue returns a ticket for a session that may run when the ticket is
+// ready, errQueueFull if there are too many waiting sessions, or
+// errQueueClosed if the queue has been shut down. When the
+// ticket is ready, the caller must call release when the session is done;
+// before, it must call leave if it does not want to wait anymore.
+func (q *queue) enqueue() (*queueTicket, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.isClosed {
+		return nil, errQueueClosed
+	}
+	ticket := &queueTicket{ready: make(chan struct{})}
+	if q.active < q.maxActive && len(q.waiting) <= 0 {
+		q.active++
+		close(ticket.ready)
+		return ticket, nil
+	}
+	if len(q.waiting) >= q.maxWaiting {
+		return nil, errQueueFull
+	}
+	q.waiting = append(q.waiting, ticket)
+	return ticket, nil
+}
+
+// position returns the one-based position of |ticket| in the queue, or
+// zero if |ticket| is not waiting anymore.
+func (q *queue) position(ticket *queueTicket) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, t := range q.waiting {
+		if t == ticket {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// leave removes |ticket| from the queue. If the ticket has become ready
+// in the meanwhile, the session slot is released.
+func (q *queue) leave(ticket *queueTicket) {
+	q.mu.Lock()
+	for i, t := range q.waiting {
+		if t == ticket {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			q.mu.Unlock()
+			return
+		}
+	}
+	q.mu.Unlock()
+	q.release()
+}
+
+// release releases the slot of a running session, passing it to the first
+// waiting session, if any.
+func (q *queue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.waiting) > 0 {
+		close(q.waiting[0].ready)
+		q.waiting = q.waiting[1:]
+		return
+	}
+	q.active--
+}
+
+// waitMinutes estimates how many minutes a session at |position| in the
+// queue will wait, assuming that the sessions run one after the other.
+func (s *Session) waitMinutes(position int) int {
+	session := 2*s.config.TestDuration + s.config.MidDuration +
+		s.config.SFWTimeout
+	wait := time.Duration(position) * session
+	return int((wait + time.Minute - 1) / time.Minute)
+}
+
+// waitInQueue waits until the session can run and then tells the client
+// that the tests start now. Clients that did not request TestStatus cannot
+// wait and are told that the server is busy. Clients waiting in queue are
+// periodically told the expected wait time in minutes and must reply to
+// heartbeats with MsgWaiting, otherwise they are dropped. When the server
+// is shutting down, waiting clients are told that there was a server
+// fault. On success, the caller must release the session slot when done.
+func (s *Session) waitInQueue() error {
+	if s.queue == nil {
+		return s.sendMsg(protocol.MsgSrvQueue, protocol.SrvQueueTestStartsNow)
+	}
+	if protocol.TestCode(s.login.Tests)&protocol.TestStatus == 0 {
+		if !s.queue.tryAcquire() {
+			s.sendMsg(protocol.MsgSrvQueue, protocol.SrvQueueServerBusy)
+			return ErrServerBusy
+		}
+		return s.startNow()
+	}
+	ticket, err := s.queue.enqueue()
+	if err == errQueueFull {
+		s.sendMsg(protocol.MsgSrvQueue, protocol.SrvQueueServerBusy60s)
+		return ErrServerBusy
+	}
+	if err == errQueueClosed {
+		s.sendMsg(protocol.MsgSrvQueue, protocol.SrvQueueServerFault)
+		return ErrServerShutdown
+	}
+	ticker := time.NewTicker(s.config.QueueHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticket.ready:
+			return s.startNow()
+		case <-s.queue.closed:
+			s.queue.leave(ticket)
+			s.sendMsg(protocol.MsgSrvQueue, protocol.SrvQueueServerFault)
+			return ErrServerShutdown
+		case <-ticker.C:
+		}
+		position := s.queue.position(ticket)
+		if position <= 0 {
+			continue // we have just become ready
+		}
+		err = s.sendMsg(protocol.MsgSrvQueue,
+			strconv.Itoa(s.waitMinutes(position)))
+		if err == nil {
+			err = s.sendMsg(protocol.MsgSrvQueue, protocol.SrvQueueHeartbeat)
+		}
+		if err == nil {
+			_, err = s.readMsg(protocol.MsgWaiting)
+		}
+		if err != nil {
+			s.queue.leave(ticket)
+			return err
+		}
+	}
+}
+
+// startNow tells the client that the tests start now. If this fails, it
+// releases the session slot.
+func (s *Session) startNow() error {
+	err := s.sendMsg(protocol.MsgSrvQueue, protocol.SrvQueueTestStartsNow)
+	if err != nil {
+		s.queue.release()
+	}
+	return err
+}
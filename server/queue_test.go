@@ -0,0 +1,166 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/m-lab/ndt-server-go/protocol"
+)
+
+func TestQueue(t *testing.T) {
+	q := newQueue(1, 2)
+	if !q.tryAcquire() {
+		t.Fatal("we should be able to run the first session")
+	}
+	if q.tryAcquire() {
+		t.Fatal("we should not be able to run the second session")
+	}
+	first, err := q.enqueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := q.enqueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.enqueue(); err != errQueueFull {
+		t.Fatal("the queue should be full")
+	}
+	if q.position(first) != 1 || q.position(second) != 2 {
+		t.Fatal("unexpected positions")
+	}
+
+	q.leave(first)
+	if q.position(first) != 0 || q.position(second) != 1 {
+		t.Fatal("unexpected positions after leave")
+	}
+	q.release()
+	select {
+	case <-second.ready:
+	default:
+		t.Fatal("the second session should be ready")
+	}
+	if q.tryAcquire() {
+		t.Fatal("the slot should have been passed to the second session")
+	}
+	q.leave(second) // leaving when ready releases the slot
+	if !q.tryAcquire() {
+		t.Fatal("the slot should have been released")
+	}
+	q.release()
+	if q.active != 0 || len(q.waiting) != 0 {
+		t.Fatal("unexpected final state: ", q.active, len(q.waiting))
+	}
+}
+
+func TestQueueEnqueueWhenIdle(t *testing.T) {
+	q := newQueue(1, 0)
+	ticket, err := q.enqueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ticket.ready:
+	default:
+		t.Fatal("the session should be ready")
+	}
+}
+
+// newQueuedTestClient is like newTestClient but the session uses |q|.
+func newQueuedTestClient(t *testing.T, q *queue) *testClient {
+	return newCustomTestClient(t, func(s *Session) {
+		s.queue = q
+	})
+}
+
+// waitInQueue reads queue messages, answering heartbeats, until the
+// session can start. Returns the number of heartbeats received.
+func (tc *testClient) waitInQueue() int {
+	var heartbeats int
+	for {
+		switch msg := tc.expect(protocol.MsgSrvQueue); msg {
+		case protocol.SrvQueueTestStartsNow:
+			return heartbeats
+		case protocol.SrvQueueHeartbeat:
+			heartbeats++
+			tc.send(protocol.MsgWaiting, "")
+		case protocol.SrvQueueServerBusy, protocol.SrvQueueServerBusy60s,
+			protocol.SrvQueueServerFault:
+			tc.t.Fatal("unexpected queue message: ", msg)
+		}
+	}
+}
+
+func TestSessionQueue(t *testing.T) {
+	q := newQueue(1, 1)
+	first := newQueuedTestClient(t, q)
+	defer first.conn.Close()
+	first.login("48")
+
+	second := newQueuedTestClient(t, q)
+	defer second.conn.Close()
+	second.sendLogin("48")
+	if msg := second.expect(protocol.MsgSrvQueue); msg != "1" {
+		t.Fatal("unexpected wait time: ", msg)
+	}
+	if msg := second.expect(protocol.MsgSrvQueue); msg != protocol.SrvQueueHeartbeat {
+		t.Fatal("expected heartbeat, got: ", msg)
+	}
+	second.send(protocol.MsgWaiting, "")
+
+	// Clients that do not support queueing are rejected immediately
+	third := newQueuedTestClient(t, q)
+	defer third.conn.Close()
+	third.sendLogin("32")
+	if msg := third.expect(protocol.MsgSrvQueue); msg != protocol.SrvQueueServerBusy {
+		t.Fatal("expected busy, got: ", msg)
+	}
+
+	// Clients that would exceed the queue length are rejected too
+	fourth := newQueuedTestClient(t, q)
+	defer fourth.conn.Close()
+	fourth.sendLogin("48")
+	if msg := fourth.expect(protocol.MsgSrvQueue); msg != protocol.SrvQueueServerBusy60s {
+		t.Fatal("expected busy 60s, got: ", msg)
+	}
+
+	first.runMeta(nil)
+	first.logout()
+	second.waitInQueue()
+	if suite := second.readSuite(); suite != "32" {
+		t.Fatal("unexpected tests suite: ", suite)
+	}
+	second.runMeta(nil)
+	second.logout()
+	<-second.done
+	if q.active != 0 || len(q.waiting) != 0 {
+		t.Error("unexpected final state: ", q.active, len(q.waiting))
+	}
+}
+
+func TestSessionQueueDropsUnresponsiveClients(t *testing.T) {
+	q := newQueue(1, 1)
+	first := newQueuedTestClient(t, q)
+	defer first.conn.Close()
+	first.login("48")
+
+	second := newQueuedTestClient(t, q)
+	second.sendLogin("48")
+	second.expect(protocol.MsgSrvQueue)
+	second.expect(protocol.MsgSrvQueue)
+	second.send(protocol.MsgTest, "not a MsgWaiting")
+	<-second.done
+	second.conn.Close()
+	if len(q.waiting) != 0 {
+		t.Error("the client should have left the queue")
+	}
+
+	first.runMeta(nil)
+	first.logout()
+	<-first.done
+	if q.active != 0 {
+		t.Error("the slot should have been released")
+	}
+}
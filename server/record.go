@@ -0,0 +1,244 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package server
+
+import (
+	"log"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/m-lab/ndt-server-go/netx"
+	"github.com/m-lab/ndt-server-go/protocol"
+	"github.com/m-lab/ndt-server-go/tcpinfo"
+)
+
+// maxTCPInfoSamples is the maximum number of TCP_INFO samples we keep for
+// each data connection. When exceeded, we keep the most recent samples.
+const maxTCPInfoSamples = 1024
+
+// Record is the result of a session, as saved in the archive.
+type Record struct {
+	UUID       string
+	StartTime  time.Time
+	EndTime    time.Time
+	ClientAddr string
+	ServerAddr string
+	// IPFamily is the IP family of the client address, "ipv4" or "ipv6".
+	// The data connections use the same family.
+	IPFamily string `json:",omitempty"`
+	// ProxyAddr is the address of the proxy that relayed the control
+	// connection, if any. ClientAddr and ServerAddr are the addresses of
+	// the original connection.
+	ProxyAddr string `json:",omitempty"`
+	Login     protocol.Login
+	Tests     []*TestResult
+	Metadata  map[string]string `json:",omitempty"`
+	Error     string            `json:",omitempty"`
+}
+
+// TestResult contains the measurements of a test. Values contains the same
+// measurements sent to the client with MsgResults.
+type TestResult struct {
+	Name      string
+	StartTime time.Time
+	EndTime   time.Time
+	Values    map[string]interface{}
+	Snapshots []Snapshot `json:",omitempty"`
+
+	// Congestion is the congestion control algorithm used by the server
+	// during downloads.
+	Congestion string `json:",omitempty"`
+
+	// Diag contains the state of the data connections collected using
+	// sock_diag, including after they have been closed.
+	Diag []tcpinfo.DiagSample `json:",omitempty"`
+
+	// SocketOptions contains the socket options of the first data
+	// connection, as applied by the kernel.
+	SocketOptions map[string]int `json:",omitempty"`
+}
+
+// Snapshot is a TCP_INFO snapshot of a data connection. Stream identifies
+// the data connection in multi-stream tests and is zero otherwise. CCInfo
+// is only read at the end of downloads.
+type Snapshot struct {
+	Time    time.Time
+	Stream  int
+	TCPInfo *tcpinfo.TCPInfo
+	CCInfo  *tcpinfo.CCInfo `json:",omitempty"`
+}
+
+// beginTest creates the result of the test |code| and makes it the current
+// one, such that subsequent results are added to it.
+func (s *Session) beginTest(code protocol.TestCode) {
+	s.current = &TestResult{
+		Name:      FormatTests(code),
+		StartTime: time.Now(),
+		Values:    make(map[string]interface{}),
+	}
+	s.tests = append(s.tests, s.current)
+}
+
+// endTest marks the end of the current test, releases its data ports and
+// adds to it the state of its data connections collected using sock_diag,
+// if enabled.
+func (s *Session) endTest() {
+	s.current.EndTime = time.Now()
+	if s.ports != nil {
+		s.ports.ReleaseAll(s.uuid)
+	}
+	if s.diag != nil && s.diagPending {
+		// Collect once more to include the final state of the sockets
+		err := s.diag.Collect()
+		if err != nil {
+			log.Println("Cannot collect sockets state:", err)
+		}
+		s.current.Diag = s.diag.Take(s.uuid)
+		s.diagPending = false
+	}
+	s.current = nil
+}
+
+// trackDataConn registers the data connection |conn| with the sock_diag
+// collector, if enabled, and records the socket options of the first data
+// connection of the current test.
+func (s *Session) trackDataConn(conn net.Conn) {
+	if s.current != nil && s.current.SocketOptions == nil {
+		s.current.SocketOptions = socketOptions(conn)
+	}
+	if s.diag == nil {
+		return
+	}
+	s.diag.Register(s.uuid, tcpinfo.NewSocketID(conn.LocalAddr(),
+		conn.RemoteAddr()))
+	s.diagPending = true
+}
+
+// socketOptions returns the socket options of |conn| by name, or nil if
+// they cannot be read.
+func socketOptions(conn net.Conn) map[string]int {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	values, err := tcpinfo.GetSockOpts(sc)
+	if err != nil {
+		log.Println("Cannot read socket options:", err)
+		return nil
+	}
+	named := make(map[string]int)
+	for opt, value := range values {
+		named[opt.String()] = value
+	}
+	return named
+}
+
+// addSnapshot adds the |info| and |cc| snapshot of the data connection
+// |stream| to the current test, if any. |cc| may be nil.
+func (s *Session) addSnapshot(stream int, info *tcpinfo.TCPInfo,
+	cc *tcpinfo.CCInfo) {
+	if s.current == nil || info == nil {
+		return
+	}
+	s.current.Snapshots = append(s.current.Snapshots, Snapshot{
+		Time:    time.Now(),
+		Stream:  stream,
+		TCPInfo: info,
+		CCInfo:  cc,
+	})
+	if cc != nil {
+		s.current.Congestion = cc.Algorithm
+	}
+}
+
+// setCongestion sets the configured S2C congestion control on |conn|, if
+// any. On failure, |conn| keeps using the system default.
+func (s *Session) setCongestion(conn *net.TCPConn) {
+	if s.config.S2CCongestion == "" {
+		return
+	}
+	err := tcpinfo.SetCongestion(conn, s.config.S2CCongestion)
+	if err != nil {
+		log.Println("Cannot set congestion control:", err)
+	}
+}
+
+// readCongestionInfo returns the congestion control information of |conn|,
+// or nil if it cannot be read.
+func readCongestionInfo(conn *net.TCPConn) *tcpinfo.CCInfo {
+	cc, err := tcpinfo.CongestionInfo(conn)
+	if err != nil {
+		log.Println("Cannot read congestion control:", err)
+		return nil
+	}
+	return cc
+}
+
+// startSampler starts sampling the TCP_INFO of |conn| at the configured
+// interval. Returns nil if sampling is disabled.
+func (s *Session) startSampler(conn *net.TCPConn) *tcpinfo.Sampler {
+	if s.config.TCPInfoInterval <= 0 {
+		return nil
+	}
+	sampler, err := tcpinfo.NewSampler(conn, s.config.TCPInfoInterval,
+		maxTCPInfoSamples)
+	if err != nil {
+		log.Println("Cannot sample TCP_INFO:", err)
+		return nil
+	}
+	return sampler
+}
+
+// stopSampler stops |sampler|, if not nil, and returns its samples.
+func stopSampler(sampler *tcpinfo.Sampler) []tcpinfo.Sample {
+	if sampler == nil {
+		return nil
+	}
+	samples, err := sampler.Stop()
+	if err != nil {
+		log.Println("TCP_INFO sampling failed:", err)
+	}
+	return samples
+}
+
+// addSamples adds |samples| of the data connection |stream| to the current
+// test, if any.
+func (s *Session) addSamples(stream int, samples []tcpinfo.Sample) {
+	if s.current == nil {
+		return
+	}
+	for _, sample := range samples {
+		s.current.Snapshots = append(s.current.Snapshots, Snapshot{
+			Time:    sample.Time,
+			Stream:  stream,
+			TCPInfo: sample.Info,
+		})
+	}
+}
+
+// record returns the Record of the session, where |err| is the error that
+// caused the session to fail, if any.
+func (s *Session) record(err error) Record {
+	r := Record{
+		UUID:       s.uuid,
+		StartTime:  s.startTime,
+		EndTime:    time.Now(),
+		ClientAddr: s.conn.RemoteAddr().String(),
+		ServerAddr: s.conn.LocalAddr().String(),
+		Login:      s.login,
+		Tests:      s.tests,
+		Metadata:   s.metadata,
+	}
+	if f := netx.AddrFamily(s.conn.RemoteAddr()); f != netx.DualStack {
+		r.IPFamily = f.String()
+	}
+	if pc, ok := s.conn.(*netx.ProxyConn); ok {
+		r.ProxyAddr = pc.ProxyAddr().String()
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r
+}
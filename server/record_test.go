@@ -0,0 +1,214 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server-go/archive"
+	"github.com/m-lab/ndt-server-go/protocol"
+	"github.com/m-lab/ndt-server-go/tcpinfo"
+)
+
+// readRecords reads the records archived in |dir|, which must contain a
+// single uncompressed archive file.
+func readRecords(t *testing.T, dir string) []Record {
+	names, err := filepath.Glob(filepath.Join(dir, "*"+archive.Extension))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 {
+		t.Fatal("unexpected archive files: ", names)
+	}
+	data, err := ioutil.ReadFile(names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []Record
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var r Record
+		err = json.Unmarshal([]byte(line), &r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestServerArchivesRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ndt-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := testConfig()
+	config.OutputDir = dir
+	config.OutputCompress = false
+	srv, address, _ := startTestServer(t, config)
+
+	tc := dialTestClient(t, address)
+	defer tc.conn.Close()
+	tc.login("48")
+	tc.runMeta([]string{"client.os.name:Linux"})
+	tc.logout()
+	err = srv.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := readRecords(t, dir)
+	if len(records) != 1 {
+		t.Fatal("unexpected number of records: ", len(records))
+	}
+	r := records[0]
+	if len(r.UUID) != 36 || r.Error != "" || r.Login.Tests != 48 {
+		t.Errorf("unexpected record: %+v", r)
+	}
+	if r.ClientAddr != tc.conn.LocalAddr().String() || r.IPFamily != "ipv4" {
+		t.Error("unexpected client address: ", r.ClientAddr, r.IPFamily)
+	}
+	if !r.StartTime.Before(r.EndTime) {
+		t.Error("unexpected record times: ", r.StartTime, r.EndTime)
+	}
+	if len(r.Tests) != 1 || r.Tests[0].Name != "meta" {
+		t.Fatal("unexpected tests: ", r.Tests)
+	}
+	if r.Metadata["client.os.name"] != "Linux" {
+		t.Error("unexpected metadata: ", r.Metadata)
+	}
+}
+
+func TestRecordValues(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.conn.Close()
+	tc.login("28") // TestSFW | TestS2C | TestStatus
+	tc.runSFW(true, true)
+	tc.runS2C()
+	tc.send(protocol.MsgTest, "1234")
+	tc.readTestMsgs()
+	tc.logout()
+	s := <-tc.done
+	r := s.record(nil)
+	if len(r.Tests) != 2 {
+		t.Fatal("unexpected tests: ", r.Tests)
+	}
+	sfw, s2c := r.Tests[0], r.Tests[1]
+	if sfw.Name != "sfw" || s2c.Name != "s2c" {
+		t.Fatal("unexpected tests names: ", sfw.Name, s2c.Name)
+	}
+	if _, ok := s2c.Values["S2CServerThroughput"].(float64); !ok {
+		t.Error("throughput should be a number: ", s2c.Values)
+	}
+	if s2c.Values["S2CClientThroughput"] != 1234.0 {
+		t.Error("unexpected client throughput: ", s2c.Values)
+	}
+	// TCP_INFO is sampled during the download and read at the end
+	if len(s2c.Snapshots) < 2 {
+		t.Fatal("expected TCP_INFO snapshots: ", s2c.Snapshots)
+	}
+	for i, snapshot := range s2c.Snapshots {
+		if snapshot.TCPInfo == nil {
+			t.Fatal("missing TCP_INFO in snapshot ", i)
+		}
+		if i > 0 && snapshot.Time.Before(s2c.Snapshots[i-1].Time) {
+			t.Error("snapshots are not in chronological order")
+		}
+	}
+	data, err := json.Marshal(sfw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"SFWClientToServer":"`) {
+		t.Error("verdicts should be archived by name: ", string(data))
+	}
+}
+
+func TestRecordCongestion(t *testing.T) {
+	allowed, err := ioutil.ReadFile("/proc/sys/net/ipv4/tcp_allowed_congestion_control")
+	if err != nil || !strings.Contains(" "+strings.TrimSpace(string(allowed))+" ", " bbr ") {
+		t.Skip("BBR is not available")
+	}
+	tc := newCustomTestClient(t, func(s *Session) {
+		s.config.S2CCongestion = "bbr"
+	})
+	defer tc.conn.Close()
+	tc.login("20")
+	tc.runS2C()
+	tc.send(protocol.MsgTest, "1234")
+	tc.readTestMsgs()
+	tc.logout()
+	s := <-tc.done
+	test := s.tests[0]
+	if test.Congestion != "bbr" {
+		t.Fatal("unexpected congestion control: ", test.Congestion)
+	}
+	last := test.Snapshots[len(test.Snapshots)-1]
+	if last.CCInfo == nil || last.CCInfo.BBR == nil || last.CCInfo.BBR.Bandwidth == 0 {
+		t.Errorf("missing BBR estimates: %+v", last.CCInfo)
+	}
+}
+
+func TestRecordSockDiag(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("sock_diag is only supported on Linux")
+	}
+	c, err := tcpinfo.NewCollector(50*time.Millisecond, maxDiagSamples)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	tc := newCustomTestClient(t, func(s *Session) {
+		s.diag = c
+	})
+	defer tc.conn.Close()
+	tc.login("20") // TestS2C | TestStatus
+	tc.runS2C()
+	tc.send(protocol.MsgTest, "1234")
+	tc.readTestMsgs()
+	tc.logout()
+	s := <-tc.done
+	diag := s.tests[0].Diag
+	// At least the final state of the socket, which has been closed by
+	// the server and hence is still known by the kernel
+	if len(diag) <= 0 {
+		t.Fatal("missing sock_diag samples")
+	}
+	for _, sample := range diag {
+		if sample.Socket.ID.Remote != diag[0].Socket.ID.Remote {
+			t.Error("unexpected socket: ", sample.Socket.ID)
+		}
+	}
+	if last := diag[len(diag)-1].Socket; last.State == 1 {
+		t.Error("the data socket should have been closed: ", last.State)
+	}
+	if samples := c.Take(s.uuid); len(samples) != 0 {
+		t.Error("the samples should have been taken by the session")
+	}
+}
+
+func TestRecordSocketOptions(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.conn.Close()
+	tc.login("17") // TestMid | TestStatus
+	tc.runMid("", "")
+	tc.logout()
+	s := <-tc.done
+	opts := s.tests[0].SocketOptions
+	// The data connection inherits the MSS set on the listener
+	if mss, ok := opts["TCP_MAXSEG"]; !ok || mss <= 0 || mss > midMSS {
+		t.Error("unexpected socket options: ", opts)
+	}
+	if _, ok := opts["SO_SNDBUF"]; !ok {
+		t.Error("missing send buffer size: ", opts)
+	}
+}
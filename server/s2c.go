@@ -0,0 +1,156 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/m-lab/ndt-server-go/netx"
+	"github.com/m-lab/ndt-server-go/protocol"
+	"github.com/m-lab/ndt-server-go/tcpinfo"
+	"github.com/m-lab/ndt-server-go/util"
+)
+
+// s2cBufferSize is the size of the buffer written by the S2C test.
+const s2cBufferSize = 8192
+
+// s2cResultMsg is the MsgTest that the server sends at the end of the S2C
+// test. The fields names are the ones expected by JSON clients.
+type s2cResultMsg struct {
+	ThroughputValue  string
+	UnsentDataAmount string
+	TotalSentByte    string
+}
+
+// MarshalLegacy implements protocol.LegacyMarshaler.
+func (m s2cResultMsg) MarshalLegacy() []byte {
+	return []byte(m.ThroughputValue + " " + m.UnsentDataAmount + " " +
+		m.TotalSentByte)
+}
+
+// sendData writes random data on |conn| for |duration|. Returns the number
+// of bytes written and the time elapsed until the last byte was written.
+func sendData(conn net.Conn, duration time.Duration) (int64, time.Duration, error) {
+	buf := util.NewBytesGenerator().GenLettersFast(s2cBufferSize)
+	mc := netx.NewMeasuringConn(conn, 0)
+	var err error
+	for time.Since(mc.Start()) < duration {
+		_, err = mc.Write(buf)
+		if err != nil {
+			break
+		}
+	}
+	m := mc.WriteMeasurement()
+	return m.Bytes, m.Elapsed(), err
+}
+
+// kbps computes the throughput in kbit/s given the number of bytes that
+// have been transferred and the transfer duration.
+func kbps(count int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(count) * 8 / 1000 / elapsed.Seconds()
+}
+
+// unsentData returns the amount of data queued in the socket of |conn|
+// that has not been sent yet. We use tcpi_notsent_bytes when the kernel
+// returns it and otherwise subtract the data in flight, which we estimate
+// from |info|, from the send queue. Returns zero if |info| is nil.
+func unsentData(conn *net.TCPConn, info *tcpinfo.TCPInfo) uint64 {
+	if info == nil {
+		return 0
+	}
+	if info.Has(tcpinfo.FieldNotsentBytes) {
+		return uint64(info.NotsentBytes)
+	}
+	queued, err := tcpinfo.OutQueue(conn)
+	if err != nil {
+		log.Println("Cannot read the send queue:", err)
+		return 0
+	}
+	inFlight := uint64(info.Unacked) * uint64(info.SndMSS)
+	if uint64(queued) <= inFlight {
+		return 0
+	}
+	return uint64(queued) - inFlight
+}
+
+// runS2C runs the single-stream download test.
+func runS2C(s *Session) error {
+	ln, port, err := s.listenData()
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	conn, _, err := s.acceptData(ln, port)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = s.sendMsg(protocol.MsgTestStart, "")
+	if err != nil {
+		return err
+	}
+
+	s.setCongestion(conn)
+	sampler := s.startSampler(conn)
+	total, elapsed, err := sendData(s.bulkConn(conn), s.config.TestDuration)
+	samples := stopSampler(sampler)
+	if err != nil {
+		return err
+	}
+	cc := readCongestionInfo(conn)
+	// Read TCP_INFO before closing, which signals the client that the
+	// download is over.
+	info, err := tcpinfo.TCPInfo2(conn)
+	if err != nil {
+		log.Println("Cannot read TCP_INFO:", err)
+	}
+	unsent := unsentData(conn, info)
+	s.addSamples(0, samples)
+	s.addSnapshot(0, info, cc)
+	conn.Close()
+
+	var vars []web100Var
+	if info != nil {
+		vars = web100Vars(info)
+	}
+	throughput := kbps(total, elapsed)
+	err = s.ctrl.SendJSON(protocol.MsgTest, s2cResultMsg{
+		ThroughputValue:  fmt.Sprintf("%.0f", throughput),
+		UnsentDataAmount: strconv.FormatUint(unsent, 10),
+		TotalSentByte:    strconv.FormatInt(total, 10),
+	})
+	if err != nil {
+		return err
+	}
+	clientThroughput, err := s.readMsg(protocol.MsgTest)
+	if err != nil {
+		return err
+	}
+	clientValue, err := strconv.ParseFloat(clientThroughput, 64)
+	if err != nil {
+		return err
+	}
+
+	lines := formatWeb100Vars(vars)
+	err = s.sendLines(protocol.MsgTest, lines)
+	if err != nil {
+		return err
+	}
+
+	s.addResult("S2CServerThroughput", throughput)
+	s.addResult("S2CClientThroughput", clientValue)
+	s.addResult("S2CTotalSentByte", total)
+	s.addResult("S2CUnsentDataAmount", unsent)
+	for _, v := range vars {
+		s.addResult(v.name, v.value)
+	}
+	return s.sendMsg(protocol.MsgTestFinalize, "")
+}
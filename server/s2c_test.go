@@ -0,0 +1,234 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server-go/netx"
+	"github.com/m-lab/ndt-server-go/protocol"
+	"github.com/m-lab/ndt-server-go/tcpinfo"
+)
+
+// dialData connects to the data port announced with MsgTestPrepare, on
+// the server address of the control connection.
+func (tc *testClient) dialData() net.Conn {
+	port := tc.expect(protocol.MsgTestPrepare)
+	host, _, _ := net.SplitHostPort(tc.conn.RemoteAddr().String())
+	conn, err := net.Dial("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	return conn
+}
+
+// readTestMsgs reads MsgTest messages until MsgTestFinalize.
+func (tc *testClient) readTestMsgs() string {
+	var msgs []string
+	for {
+		mt, body := tc.read()
+		switch mt {
+		case protocol.MsgTest:
+			msgs = append(msgs, body)
+		case protocol.MsgTestFinalize:
+			return strings.Join(msgs, "")
+		default:
+			tc.t.Fatal("unexpected message: ", mt)
+		}
+	}
+}
+
+// runS2C runs the client side of the S2C test and returns the number of
+// bytes received and the server results message.
+func (tc *testClient) runS2C() (int64, []byte) {
+	conn := tc.dialData()
+	defer conn.Close()
+	tc.expect(protocol.MsgTestStart)
+	count, err := io.Copy(ioutil.Discard, conn)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	return count, tc.expectRaw(protocol.MsgTest)
+}
+
+func TestS2CExtended(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.conn.Close()
+	suite := tc.login("20")
+	if suite != "4" {
+		t.Fatal("unexpected tests suite: ", suite)
+	}
+	count, raw := tc.runS2C()
+	var msg s2cResultMsg
+	err := json.Unmarshal(raw, &msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.TotalSentByte == "" || msg.ThroughputValue == "" {
+		t.Fatal("unexpected results message: ", string(raw))
+	}
+	if count <= 0 {
+		t.Error("no data received")
+	}
+	tc.send(protocol.MsgTest, "1234")
+	vars := tc.readTestMsgs()
+	if !strings.Contains(vars, "CurMSS: ") {
+		t.Error("missing web100 variables: ", vars)
+	}
+	results := tc.logout()
+	if !strings.Contains(results, "S2CClientThroughput: 1234.00\n") {
+		t.Error("missing client throughput: ", results)
+	}
+	if !strings.Contains(results, "S2CTotalSentByte: "+msg.TotalSentByte) {
+		t.Error("missing total sent bytes: ", results)
+	}
+}
+
+func TestS2CRateLimited(t *testing.T) {
+	const rate = 4000 // kbit/s
+	tb, err := netx.NewTokenBucket(rate*1000/8, 16*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := newCustomTestClient(t, func(s *Session) {
+		s.egress = tb
+	})
+	defer tc.conn.Close()
+	tc.login("20")
+	_, raw := tc.runS2C()
+	var msg s2cResultMsg
+	err = json.Unmarshal(raw, &msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	throughput, err := strconv.ParseFloat(msg.ThroughputValue, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if throughput < 0.75*rate || throughput > 1.25*rate {
+		t.Error("the egress rate was not honored: ", throughput)
+	}
+	tc.send(protocol.MsgTest, "1234")
+	tc.readTestMsgs()
+	tc.logout()
+}
+
+func TestS2CLegacy(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.conn.Close()
+	tc.legacy = true
+	tc.login("20")
+	_, raw := tc.runS2C()
+	if len(strings.Split(string(raw), " ")) != 3 {
+		t.Fatal("unexpected results message: ", string(raw))
+	}
+	tc.send(protocol.MsgTest, "1234")
+	tc.readTestMsgs()
+	tc.logout()
+}
+
+func TestS2CInvalidClientThroughput(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.conn.Close()
+	tc.login("20")
+	tc.runS2C()
+	tc.send(protocol.MsgTest, "xo")
+	_, err := protocol.ReadMessage(tc.rdwr.Reader)
+	if err == nil {
+		t.Error("the server should have closed the connection")
+	}
+}
+
+func TestKbps(t *testing.T) {
+	if kbps(1000, 0) != 0 {
+		t.Error("zero elapsed time should yield zero throughput")
+	}
+	if kbps(1250, 1e9) != 10 {
+		t.Error("unexpected throughput: ", kbps(1250, 1e9))
+	}
+}
+
+func TestUnsentData(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("TCP_INFO is only supported on Linux")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peer, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	tcp := conn.(*net.TCPConn)
+	// Fill the send queue, since the peer does not read
+	buf := make([]byte, 64*1024)
+	for {
+		conn.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+		if _, err := conn.Write(buf); err != nil {
+			break
+		}
+	}
+	info, err := tcpinfo.TCPInfo2(tcp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued, err := tcpinfo.OutQueue(tcp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inFlight := uint64(info.Unacked) * uint64(info.SndMSS)
+	unsent := unsentData(tcp, info)
+	if unsent == 0 || unsent > uint64(queued) {
+		t.Fatal("unexpected unsent data: ", unsent, queued)
+	}
+	if info.Has(tcpinfo.FieldNotsentBytes) && unsent != uint64(info.NotsentBytes) {
+		t.Error("unsent data should be tcpi_notsent_bytes: ", unsent)
+	}
+	// Without tcpi_notsent_bytes, we use the send queue
+	info.Present &^= 1 << tcpinfo.FieldNotsentBytes
+	if unsent = unsentData(tcp, info); unsent != uint64(queued)-inFlight {
+		t.Error("unexpected unsent data without tcpi_notsent_bytes: ", unsent)
+	}
+	if unsentData(tcp, nil) != 0 {
+		t.Error("unsent data should be zero without TCP_INFO")
+	}
+}
+
+func TestWeb100Vars(t *testing.T) {
+	info := &tcpinfo.TCPInfo{SndMSS: 1000, SndCwnd: 10, SndWnd: 65535}
+	names := func() map[string]uint64 {
+		m := make(map[string]uint64)
+		for _, v := range web100Vars(info) {
+			m[v.name] = v.value
+		}
+		return m
+	}
+	vars := names()
+	if _, ok := vars["CurRwinRcvd"]; ok {
+		t.Error("CurRwinRcvd reported without tcpi_snd_wnd")
+	}
+	if vars["CurCwnd"] != 10000 {
+		t.Error("unexpected CurCwnd: ", vars["CurCwnd"])
+	}
+	info.Present = 1 << tcpinfo.FieldSndWnd
+	if vars = names(); vars["CurRwinRcvd"] != 65535 {
+		t.Error("unexpected CurRwinRcvd: ", vars["CurRwinRcvd"])
+	}
+}
@@ -0,0 +1,257 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/m-lab/ndt-server-go/archive"
+	"github.com/m-lab/ndt-server-go/netx"
+	"github.com/m-lab/ndt-server-go/tcpinfo"
+)
+
+const (
+	// DefaultDrainTimeout is the default time we allow running sessions
+	// to complete when shutting down.
+	DefaultDrainTimeout = 60 * time.Second
+
+	// maxAcceptBackoff is the maximum time we wait before accepting again
+	// after a temporary accept error (e.g. EMFILE).
+	maxAcceptBackoff = time.Second
+
+	// interruptTimeout is the time we allow the sessions interrupted by
+	// Shutdown to archive their results.
+	interruptTimeout = 5 * time.Second
+
+	// maxDiagSamples is the maximum number of sock_diag samples we keep
+	// for each session test. When exceeded, we keep the most recent ones.
+	maxDiagSamples = 1024
+)
+
+// ErrServerClosed is returned by Serve after Shutdown has been called.
+var ErrServerClosed = errors.New("Server closed")
+
+// Server runs NDT sessions sharing the same configuration and queue.
+type Server struct {
+	config    Config
+	queue     *queue
+	archive   *archive.Writer
+	diag      *tcpinfo.Collector
+	egress    *netx.TokenBucket
+	proxies   []*net.IPNet
+	ports     *netx.PortAllocator
+	mu        sync.Mutex
+	closing   bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	sessions  sync.WaitGroup
+}
+
+// NewServer creates a new Server using |config|. If the configured maximum
+// number of active sessions is positive, excess sessions wait in queue. If
+// the output directory is set, the result of each session is archived there.
+// If the sock_diag interval is set, a single collector periodically dumps
+// the data sockets of all the sessions. If the maximum egress rate is set,
+// the data sent by all the sessions shares a single token bucket. If there
+// are trusted proxies, their connections must start with a PROXY header.
+// If the data ports range is set, all the sessions allocate their data
+// ports from it.
+func NewServer(config Config) (*Server, error) {
+	srv := &Server{
+		config:    config,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+	if config.MaxActiveSessions > 0 {
+		srv.queue = newQueue(config.MaxActiveSessions, config.MaxQueuedSessions)
+	}
+	if config.OutputDir != "" {
+		w, err := archive.NewWriter(archive.Config{
+			Dir:      config.OutputDir,
+			MaxSize:  config.OutputMaxSize,
+			MaxAge:   config.OutputMaxAge,
+			Compress: config.OutputCompress,
+		})
+		if err != nil {
+			return nil, err
+		}
+		srv.archive = w
+	}
+	if config.DiagInterval > 0 {
+		c, err := tcpinfo.NewCollector(config.DiagInterval, maxDiagSamples)
+		if err != nil {
+			return nil, err
+		}
+		srv.diag = c
+	}
+	if config.MaxEgressRate > 0 {
+		tb, err := netx.NewTokenBucket(config.MaxEgressRate/8, 0)
+		if err != nil {
+			return nil, err
+		}
+		srv.egress = tb
+	}
+	proxies, err := netx.ParseCIDRs(config.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	srv.proxies = proxies
+	if config.DataPortMin > 0 {
+		pa, err := netx.NewPortAllocator(config.DataPortMin, config.DataPortMax)
+		if err != nil {
+			return nil, err
+		}
+		srv.ports = pa
+	}
+	return srv, nil
+}
+
+// Serve accepts control connections using |ln| and runs a session for each
+// of them in a background goroutine. Temporary accept errors are retried
+// with exponential backoff. Returns ErrServerClosed after Shutdown, or the
+// error that caused Accept to fail otherwise.
+func (srv *Server) Serve(ln net.Listener) error {
+	srv.mu.Lock()
+	if srv.closing {
+		srv.mu.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	srv.listeners[ln] = struct{}{}
+	srv.mu.Unlock()
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.listeners, ln)
+		srv.mu.Unlock()
+	}()
+
+	if len(srv.proxies) > 0 {
+		ln = netx.NewProxyListener(ln, srv.proxies)
+	}
+	var backoff time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if srv.isClosing() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				backoff *= 2
+				if backoff <= 0 {
+					backoff = 5 * time.Millisecond
+				}
+				if backoff > maxAcceptBackoff {
+					backoff = maxAcceptBackoff
+				}
+				log.Printf("Accept error: %s; retrying in %s\n", err, backoff)
+				time.Sleep(backoff)
+				continue
+			}
+			return err
+		}
+		backoff = 0
+		go srv.ServeConn(conn)
+	}
+}
+
+// isClosing returns whether Shutdown has been called.
+func (srv *Server) isClosing() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.closing
+}
+
+// ServeConn runs a NDT session on |conn| and closes |conn| when done.
+func (srv *Server) ServeConn(conn net.Conn) {
+	defer conn.Close()
+	srv.mu.Lock()
+	if srv.closing {
+		srv.mu.Unlock()
+		return
+	}
+	srv.conns[conn] = struct{}{}
+	srv.sessions.Add(1)
+	srv.mu.Unlock()
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.conns, conn)
+		srv.mu.Unlock()
+		srv.sessions.Done()
+	}()
+
+	s := NewSession(conn, srv.config)
+	s.queue = srv.queue
+	s.diag = srv.diag
+	s.egress = srv.egress
+	s.proxies = srv.proxies
+	s.ports = srv.ports
+	err := s.Run()
+	if err != nil {
+		log.Println("Session with", conn.RemoteAddr(), "failed:", err)
+	}
+	if srv.archive != nil {
+		err = srv.archive.Write(s.record(err))
+		if err != nil {
+			log.Println("Cannot archive session", s.uuid, "result:", err)
+		}
+	}
+}
+
+// Shutdown stops accepting connections, tells the clients waiting in queue
+// that the server is shutting down and waits for the running sessions to
+// complete. If |ctx| expires first, Shutdown closes the control connections
+// of the sessions still running, waits a little for them to archive their
+// results and returns the context error. In both cases, the results archive
+// and the sock_diag collector are closed.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.mu.Lock()
+	srv.closing = true
+	for ln := range srv.listeners {
+		ln.Close()
+	}
+	srv.mu.Unlock()
+	if srv.queue != nil {
+		srv.queue.shutdown()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		srv.sessions.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return srv.closeOutputs()
+	case <-ctx.Done():
+	}
+	srv.mu.Lock()
+	for conn := range srv.conns {
+		conn.Close()
+	}
+	srv.mu.Unlock()
+	select {
+	case <-done:
+	case <-time.After(interruptTimeout):
+		log.Println("Some interrupted sessions did not archive their results")
+	}
+	srv.closeOutputs()
+	return ctx.Err()
+}
+
+// closeOutputs stops the sock_diag collector and closes the results
+// archive, if any.
+func (srv *Server) closeOutputs() error {
+	if srv.diag != nil {
+		srv.diag.Stop()
+	}
+	if srv.archive == nil {
+		return nil
+	}
+	return srv.archive.Close()
+}
@@ -0,0 +1,174 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server-go/protocol"
+)
+
+// startTestServer starts a Server using |config| on the loopback. Returns
+// the server, its address and the channel where Serve's result is posted.
+func startTestServer(t *testing.T, config Config) (*Server, string, chan error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.Serve(ln)
+	}()
+	return srv, ln.Addr().String(), errs
+}
+
+func TestServerShutdownDrainsSessions(t *testing.T) {
+	config := testConfig()
+	config.MaxActiveSessions = 1
+	srv, address, errs := startTestServer(t, config)
+
+	running := dialTestClient(t, address)
+	defer running.conn.Close()
+	running.login("48")
+
+	queued := dialTestClient(t, address)
+	defer queued.conn.Close()
+	queued.sendLogin("48")
+	queued.expect(protocol.MsgSrvQueue)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- srv.Shutdown(context.Background())
+	}()
+	if err := <-errs; err != ErrServerClosed {
+		t.Error("unexpected Serve error: ", err)
+	}
+	// Queued clients are told that the server is going away
+	for {
+		msg := queued.expect(protocol.MsgSrvQueue)
+		if msg == protocol.SrvQueueServerFault {
+			break
+		}
+		if msg == protocol.SrvQueueHeartbeat {
+			queued.send(protocol.MsgWaiting, "")
+		}
+	}
+	// We do not accept new clients
+	if conn, err := net.Dial("tcp", address); err == nil {
+		conn.Close()
+		t.Error("the listener should have been closed")
+	}
+	// Running sessions can complete
+	select {
+	case err := <-shutdown:
+		t.Fatal("Shutdown returned before the session completed: ", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	running.runMeta(nil)
+	running.logout()
+	if err := <-shutdown; err != nil {
+		t.Error("unexpected Shutdown error: ", err)
+	}
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	srv, address, _ := startTestServer(t, testConfig())
+	tc := dialTestClient(t, address)
+	defer tc.conn.Close()
+	tc.login("48")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Error("unexpected Shutdown error: ", err)
+	}
+	// The control connection of the running session has been closed
+	tc.expect(protocol.MsgTestPrepare)
+	tc.expect(protocol.MsgTestStart)
+	_, err := protocol.ReadMessage(tc.rdwr.Reader)
+	if err == nil {
+		t.Error("the control connection should have been closed")
+	}
+	if err := srv.Serve(&fakeListener{}); err != ErrServerClosed {
+		t.Error("Serve should fail after Shutdown: ", err)
+	}
+}
+
+func TestServerShutdownArchivesInterruptedSessions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ndt-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := testConfig()
+	config.OutputDir = dir
+	config.OutputCompress = false
+	srv, address, _ := startTestServer(t, config)
+	tc := dialTestClient(t, address)
+	defer tc.conn.Close()
+	tc.login("20") // TestS2C | TestStatus
+	conn := tc.dialData()
+	defer conn.Close()
+	go io.Copy(ioutil.Discard, conn)
+	// The session notices that its control connection has been closed
+	// only at the end of the download, after the drain timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Error("unexpected Shutdown error: ", err)
+	}
+	records := readRecords(t, dir)
+	if len(records) != 1 || records[0].Error == "" {
+		t.Errorf("unexpected records: %+v", records)
+	}
+}
+
+// fakeListener is a net.Listener whose Accept returns the errors in |errs|
+// and then a closed connection.
+type fakeListener struct {
+	net.Listener
+	errs []error
+}
+
+func (fl *fakeListener) Accept() (net.Conn, error) {
+	if len(fl.errs) > 0 {
+		err := fl.errs[0]
+		fl.errs = fl.errs[1:]
+		return nil, err
+	}
+	client, server := net.Pipe()
+	client.Close()
+	return server, nil
+}
+
+func (fl *fakeListener) Close() error {
+	return nil
+}
+
+func TestServerRetriesTemporaryAcceptErrors(t *testing.T) {
+	srv, err := NewServer(testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fatal := errors.New("fatal accept error")
+	fl := &fakeListener{errs: []error{
+		&net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE},
+		&net.OpError{Op: "accept", Net: "tcp", Err: syscall.ECONNABORTED},
+		fatal,
+	}}
+	if err := srv.Serve(fl); err != fatal {
+		t.Error("unexpected Serve error: ", err)
+	}
+}
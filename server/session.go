@@ -0,0 +1,356 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+// Package server implements the server side of the NDT protocol.
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/m-lab/ndt-server-go/netx"
+	"github.com/m-lab/ndt-server-go/protocol"
+	"github.com/m-lab/ndt-server-go/tcpinfo"
+	"github.com/m-lab/ndt-server-go/util"
+)
+
+// Spec: https://github.com/ndt-project/ndt/wiki/NDTProtocol
+
+const (
+	// Version is the version string announced to clients. Clients compare
+	// it with their own version, hence we mimic the reference server.
+	Version = "v3.7.0 (ndt-server-go)"
+
+	// KickoffMessage is sent right after login to prove to old clients
+	// that they are actually talking with a NDT server.
+	KickoffMessage = "123456 654321"
+
+	// maxResultsLength is the maximum length of a single MsgResults
+	// message. Longer results are split across many messages.
+	maxResultsLength = 8192
+)
+
+// testRunner runs a specific test within the context of a session.
+type testRunner func(s *Session) error
+
+// testEntry associates a test code with the function running the test.
+type testEntry struct {
+	code protocol.TestCode
+	run  testRunner
+}
+
+// testSuite contains the tests we implement, in the same order in which
+// the reference server runs them. We only run the tests that have been
+// requested by the client during the login.
+var testSuite = []testEntry{
+	{protocol.TestMid, runMid},
+	{protocol.TestSFW, runSFW},
+	{protocol.TestC2S, runC2S},
+	{protocol.TestC2SExt, runC2SExt},
+	{protocol.TestS2C, runS2C},
+	{protocol.TestS2CExt, runS2CExt},
+	{protocol.TestMeta, runMeta},
+}
+
+// Session is a NDT session with a client. It contains the state shared
+// by the control channel and by the tests run on behalf of the client.
+type Session struct {
+	config   Config
+	conn     net.Conn
+	dc       *netx.DeadlineConn
+	rdwr     *bufio.ReadWriter
+	ctrl     *protocol.Conn
+	login    protocol.Login
+	results  []string
+	metadata map[string]string
+	queue    *queue
+	diag     *tcpinfo.Collector
+	egress   *netx.TokenBucket
+	proxies  []*net.IPNet
+	ports    *netx.PortAllocator
+
+	uuid      string
+	startTime time.Time
+	deadline  time.Time
+	tests     []*TestResult
+	current   *TestResult
+
+	diagPending bool
+}
+
+// ErrNoSessionUUID is returned by Run when the session has no UUID, which
+// also identifies its data ports and sockets in the shared server state.
+var ErrNoSessionUUID = errors.New("Cannot generate session UUID")
+
+// NewSession creates a new Session using |conn| as control connection
+// and |config| as configuration.
+func NewSession(conn net.Conn, config Config) *Session {
+	dc := netx.NewDeadlineConnWithTimeout(conn, config.ControlTimeout)
+	rdwr := bufio.NewReadWriter(bufio.NewReader(dc), bufio.NewWriter(dc))
+	uuid, err := util.NewUUID()
+	if err != nil {
+		log.Println("Cannot generate session UUID:", err)
+	}
+	return &Session{
+		config:    config,
+		conn:      conn,
+		dc:        dc,
+		rdwr:      rdwr,
+		ctrl:      protocol.NewConn(rdwr),
+		uuid:      uuid,
+		startTime: time.Now(),
+	}
+}
+
+// Run runs the session state machine until the client is logged out.
+func (s *Session) Run() error {
+	if s.uuid == "" {
+		return ErrNoSessionUUID
+	}
+	login, err := s.ctrl.ReadLogin()
+	if err != nil {
+		return err
+	}
+	s.login = login
+	log.Printf("Login from %s: %+v\n", s.conn.RemoteAddr(), login)
+
+	_, err = s.rdwr.WriteString(KickoffMessage)
+	if err != nil {
+		return err
+	}
+	err = s.rdwr.Flush()
+	if err != nil {
+		return err
+	}
+	err = s.waitInQueue()
+	if err != nil {
+		return err
+	}
+	if s.queue != nil {
+		defer s.queue.release()
+	}
+	s.startDeadline()
+	err = s.sendMsg(protocol.MsgLogin, Version)
+	if err != nil {
+		return err
+	}
+
+	var selected []testEntry
+	var codes []string
+	enabled := protocol.TestCode(login.Tests) & s.config.EnabledTests
+	for _, t := range testSuite {
+		if enabled&t.code != 0 {
+			selected = append(selected, t)
+			codes = append(codes, strconv.Itoa(int(t.code)))
+		}
+	}
+	err = s.sendMsg(protocol.MsgLogin, strings.Join(codes, " "))
+	if err != nil {
+		return err
+	}
+	for _, t := range selected {
+		s.beginTest(t.code)
+		err = t.run(s)
+		s.endTest()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s.sendResults()
+	if err != nil {
+		return err
+	}
+	return s.sendMsg(protocol.MsgLogout, "")
+}
+
+// startDeadline starts the session deadline, if a session timeout is
+// configured, and applies it to the control connection.
+func (s *Session) startDeadline() {
+	if s.config.SessionTimeout <= 0 {
+		return
+	}
+	s.deadline = time.Now().Add(s.config.SessionTimeout)
+	s.dc.SetSessionDeadline(s.deadline)
+}
+
+// addResult adds the |key|, |value| pair to the results that will be
+// sent to the client at the end of the session and to the current test
+// result, if any. Floating point values are sent with two decimals.
+func (s *Session) addResult(key string, value interface{}) {
+	if s.current != nil {
+		s.current.Values[key] = value
+	}
+	if f, ok := value.(float64); ok {
+		value = strconv.FormatFloat(f, 'f', 2, 64)
+	}
+	s.results = append(s.results, fmt.Sprintf("%s: %v\n", key, value))
+}
+
+// sendResults sends the results to the client.
+func (s *Session) sendResults() error {
+	return s.sendLines(protocol.MsgResults, s.results)
+}
+
+// sendLines sends |lines| as messages of type |t|, possibly using more than
+// a single message if the lines do not fit into a single message.
+func (s *Session) sendLines(t byte, lines []string) error {
+	var chunk string
+	for _, line := range lines {
+		if len(chunk) > 0 && len(chunk)+len(line) > maxResultsLength {
+			err := s.sendMsg(t, chunk)
+			if err != nil {
+				return err
+			}
+			chunk = ""
+		}
+		chunk += line
+	}
+	if len(chunk) <= 0 {
+		return nil
+	}
+	return s.sendMsg(t, chunk)
+}
+
+// ErrNoDataPort is returned when all the ports in the configured data
+// ports range are in use by other sessions or by other processes.
+var ErrNoDataPort = errors.New("Server busy: all data ports are in use")
+
+// listenData creates a listener for a data connection that will stop
+// accepting connections after the configured data timeout. The listener
+// uses a port allocated from the configured range, if any, or an ephemeral
+// port. Allocated ports are released at the end of the current test. When
+// all the ports are in use, we tell the client with MsgError. Returns the
+// listener and the port on which it is listening.
+func (s *Session) listenData() (net.Listener, int, error) {
+	deadline := time.Now().Add(s.config.DataTimeout)
+	if !s.deadline.IsZero() && s.deadline.Before(deadline) {
+		deadline = s.deadline
+	}
+	// Unlike the control listeners, the data listeners must not share their
+	// port with other processes, e.g. a draining server, hence no ReusePort.
+	options := netx.ListenOptions{Family: s.config.IPFamily}
+	// Listen on the address on which the control connection arrived, such
+	// that the data connections use the same family as the control one.
+	local := &net.TCPAddr{}
+	if addr, ok := s.localAddr().(*net.TCPAddr); ok {
+		local.IP, local.Zone = addr.IP, addr.Zone
+		options.Family = netx.IPFamily(addr.IP)
+	}
+	if s.config.DataPortMin <= 0 {
+		ln, err := netx.NewTCPListenerWithOptions(local.String(), deadline, options)
+		if err != nil {
+			return nil, 0, err
+		}
+		return ln, ln.Addr().(*net.TCPAddr).Port, nil
+	}
+	if s.ports == nil {
+		pa, err := netx.NewPortAllocator(s.config.DataPortMin, s.config.DataPortMax)
+		if err != nil {
+			return nil, 0, err
+		}
+		s.ports = pa
+	}
+	// Ports we cannot bind, e.g. because another process uses them, stay
+	// allocated until we are done such that we do not try them again.
+	var unusable []int
+	defer func() {
+		for _, port := range unusable {
+			s.ports.Release(port)
+		}
+	}()
+	for i := 0; i < s.ports.Size(); i++ {
+		port, err := s.ports.Allocate(s.uuid)
+		if err != nil {
+			break // ErrPortRangeFull
+		}
+		local.Port = port
+		ln, err := netx.NewTCPListenerWithOptions(local.String(), deadline, options)
+		if err == nil {
+			return ln, port, nil
+		}
+		unusable = append(unusable, port)
+	}
+	s.sendMsg(protocol.MsgError, ErrNoDataPort.Error())
+	return nil, 0, ErrNoDataPort
+}
+
+// localAddr returns the local address of the control connection socket.
+// Unlike s.conn.LocalAddr(), this is not the original destination of the
+// connections relayed by proxies.
+func (s *Session) localAddr() net.Addr {
+	if pc, ok := s.conn.(*netx.ProxyConn); ok {
+		return pc.Conn.LocalAddr()
+	}
+	return s.conn.LocalAddr()
+}
+
+// dataConn wraps |conn| such that its I/O uses the configured data timeout
+// and the session deadline, and its writes share the server egress rate.
+func (s *Session) dataConn(conn net.Conn) *netx.DeadlineConn {
+	if s.egress != nil {
+		conn = netx.NewRateLimitedConn(conn, nil, s.egress)
+	}
+	dc := netx.NewDeadlineConnWithTimeout(conn, s.config.DataTimeout)
+	dc.SetSessionDeadline(s.deadline)
+	return dc
+}
+
+// bulkConn is like dataConn but the data timeout is suspended, such that
+// the timed transfer loops are only bound by the session deadline.
+func (s *Session) bulkConn(conn net.Conn) *netx.DeadlineConn {
+	dc := s.dataConn(conn)
+	dc.Suspend()
+	return dc
+}
+
+// acceptData announces to the client the port on which |ln| listens using
+// a MsgTestPrepare message and accepts the data connection. Returns the
+// data connection and its view from the client, as in accept.
+func (s *Session) acceptData(ln net.Listener, port int) (*net.TCPConn, net.Conn, error) {
+	err := s.sendMsg(protocol.MsgTestPrepare, strconv.Itoa(port))
+	if err != nil {
+		return nil, nil, err
+	}
+	return s.accept(ln)
+}
+
+// accept accepts a data connection using |ln| and tracks it. Returns the
+// TCP connection and the connection whose addresses are the ones seen by
+// the client, which differ when the client is behind a trusted proxy.
+func (s *Session) accept(ln net.Listener) (*net.TCPConn, net.Conn, error) {
+	if len(s.proxies) > 0 {
+		ln = netx.NewProxyListener(ln, s.proxies)
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		return nil, nil, err
+	}
+	peer := conn
+	if pc, ok := conn.(*netx.ProxyConn); ok {
+		_, err = pc.Header()
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		conn = pc.Conn
+	}
+	s.trackDataConn(conn)
+	return conn.(*net.TCPConn), peer, nil
+}
+
+// sendMsg sends |msg| as a message of type |t| to the client.
+func (s *Session) sendMsg(t byte, msg string) error {
+	return s.ctrl.SendString(t, msg)
+}
+
+// readMsg reads a message of type |t| from the client and returns its body.
+func (s *Session) readMsg(t byte) (string, error) {
+	return s.ctrl.ReadString(t)
+}
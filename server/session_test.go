@@ -0,0 +1,458 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server-go/netx"
+	"github.com/m-lab/ndt-server-go/protocol"
+)
+
+func init() {
+	// Always prepend the filename and line number.
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+}
+
+// testClient is a minimal NDT client speaking either the JSON protocol or,
+// when |legacy| is true, the legacy binary protocol.
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	rdwr   *bufio.ReadWriter
+	legacy bool
+	done   chan *Session
+
+	// proxySource, if set, is the source address claimed by the PROXY
+	// headers sent on the data connections of the firewall test.
+	proxySource string
+}
+
+// testConfig is the configuration used to run the tests quickly.
+func testConfig() Config {
+	config := DefaultConfig()
+	config.TestDuration = 250 * time.Millisecond
+	config.MidDuration = 100 * time.Millisecond
+	config.SFWTimeout = 250 * time.Millisecond
+	config.QueueHeartbeatInterval = 50 * time.Millisecond
+	return config
+}
+
+// newTestClient starts a server on the loopback and connects to it.
+func newTestClient(t *testing.T) *testClient {
+	return newCustomTestClient(t, nil)
+}
+
+// newCustomTestClient is like newTestClient but calls |setup|, if not
+// nil, to customize the session before running it.
+func newCustomTestClient(t *testing.T, setup func(*Session)) *testClient {
+	return newTestClientOn(t, "127.0.0.1:0", setup)
+}
+
+// newTestClientOn is like newCustomTestClient but the server listens on
+// |address|.
+func newTestClientOn(t *testing.T, address string, setup func(*Session)) *testClient {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan *Session, 1)
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		s := NewSession(conn, testConfig())
+		if setup != nil {
+			setup(s)
+		}
+		err = s.Run()
+		if err != nil {
+			log.Println("Session failed:", err)
+		}
+		done <- s
+	}()
+	tc := dialTestClient(t, ln.Addr().String())
+	tc.done = done
+	return tc
+}
+
+// dialTestClient creates a testClient connected to |address|.
+func dialTestClient(t *testing.T, address string) *testClient {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testClient{
+		t:    t,
+		conn: conn,
+		rdwr: bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)),
+	}
+}
+
+func (tc *testClient) send(t byte, msg string) {
+	var err error
+	if tc.legacy {
+		err = protocol.Send(tc.rdwr.Writer, t, []byte(msg))
+	} else {
+		err = protocol.SendJSON(tc.rdwr.Writer, t, protocol.SimpleMsg{Msg: msg})
+	}
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+}
+
+// expectRaw reads a message of type |t| and returns its raw content.
+func (tc *testClient) expectRaw(t byte) []byte {
+	msg, err := protocol.ReadMessage(tc.rdwr.Reader)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	if msg.Header.MsgType != t {
+		tc.t.Fatal("expected message ", t, " but got ", msg.Header.MsgType)
+	}
+	return msg.Content
+}
+
+// read reads any message and returns its type and body.
+func (tc *testClient) read() (byte, string) {
+	msg, err := protocol.ReadMessage(tc.rdwr.Reader)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	if tc.legacy {
+		return msg.Header.MsgType, string(msg.Content)
+	}
+	var sm protocol.SimpleMsg
+	err = json.Unmarshal(msg.Content, &sm)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	return msg.Header.MsgType, sm.Msg
+}
+
+func (tc *testClient) expect(t byte) string {
+	mt, body := tc.read()
+	if mt != t {
+		tc.t.Fatal("expected message ", t, " but got ", mt)
+	}
+	return body
+}
+
+// login logs in requesting |tests| and consumes the messages sent by the
+// server up to, and including, the tests suite, which is returned.
+func (tc *testClient) login(tests string) string {
+	tc.sendLogin(tests)
+	if q := tc.expect(protocol.MsgSrvQueue); q != protocol.SrvQueueTestStartsNow {
+		tc.t.Fatal("unexpected queue message: ", q)
+	}
+	return tc.readSuite()
+}
+
+// sendLogin sends the login message requesting |tests| and reads the
+// kickoff message.
+func (tc *testClient) sendLogin(tests string) {
+	code, err := strconv.Atoi(tests)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	mt := protocol.MsgExtendedLogin
+	m, err := json.Marshal(map[string]string{"msg": "v3.7.0", "tests": tests})
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	if tc.legacy {
+		mt = protocol.MsgLogin
+		m = append([]byte{byte(code)}, "v3.7.0"...)
+	}
+	err = protocol.Send(tc.rdwr.Writer, mt, m)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	kickoff := make([]byte, len(KickoffMessage))
+	_, err = io.ReadFull(tc.rdwr, kickoff)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	if string(kickoff) != KickoffMessage {
+		tc.t.Fatal("unexpected kickoff message: ", string(kickoff))
+	}
+}
+
+// readSuite reads the version and returns the tests suite.
+func (tc *testClient) readSuite() string {
+	if v := tc.expect(protocol.MsgLogin); v != Version {
+		tc.t.Fatal("unexpected version: ", v)
+	}
+	return tc.expect(protocol.MsgLogin)
+}
+
+// logout consumes the results and the logout message.
+func (tc *testClient) logout() string {
+	var results []string
+	for {
+		mt, body := tc.read()
+		switch mt {
+		case protocol.MsgResults:
+			results = append(results, body)
+		case protocol.MsgLogout:
+			return strings.Join(results, "")
+		default:
+			tc.t.Fatal("unexpected message: ", mt)
+		}
+	}
+}
+
+func TestSessionWithoutTests(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.conn.Close()
+	suite := tc.login("16")
+	if suite != "" {
+		t.Error("unexpected tests suite: ", suite)
+	}
+	tc.logout()
+}
+
+func TestSessionWithLegacyLogin(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.conn.Close()
+	tc.legacy = true
+	suite := tc.login("16")
+	if suite != "" {
+		t.Error("unexpected tests suite: ", suite)
+	}
+	tc.logout()
+}
+
+func TestSessionRunsRequestedTests(t *testing.T) {
+	saved := testSuite
+	defer func() { testSuite = saved }()
+	var ran []protocol.TestCode
+	fake := func(code protocol.TestCode) testRunner {
+		return func(s *Session) error {
+			ran = append(ran, code)
+			s.addResult("Fake", int(code))
+			return nil
+		}
+	}
+	testSuite = []testEntry{
+		{protocol.TestMid, fake(protocol.TestMid)},
+		{protocol.TestC2S, fake(protocol.TestC2S)},
+		{protocol.TestS2C, fake(protocol.TestS2C)},
+	}
+
+	tc := newTestClient(t)
+	defer tc.conn.Close()
+	suite := tc.login("21") // TestMid | TestS2C | TestStatus
+	if suite != "1 4" {
+		t.Error("unexpected tests suite: ", suite)
+	}
+	results := tc.logout()
+	if results != "Fake: 1\nFake: 4\n" {
+		t.Error("unexpected results: ", results)
+	}
+	if len(ran) != 2 || ran[0] != protocol.TestMid || ran[1] != protocol.TestS2C {
+		t.Error("unexpected tests run: ", ran)
+	}
+}
+
+func TestSessionTimeout(t *testing.T) {
+	tc := newCustomTestClient(t, func(s *Session) {
+		s.config.SessionTimeout = 200 * time.Millisecond
+	})
+	defer tc.conn.Close()
+	tc.login("18") // TestC2S | TestStatus
+	tc.expect(protocol.MsgTestPrepare)
+	// Do not connect: the session should fail well before DataTimeout
+	select {
+	case <-tc.done:
+	case <-time.After(testConfig().DataTimeout / 2):
+		t.Fatal("the session deadline was not honored")
+	}
+}
+
+func TestSessionSplitsResults(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	rdwr := bufio.NewReadWriter(bufio.NewReader(buf), bufio.NewWriter(buf))
+	s := &Session{rdwr: rdwr, ctrl: protocol.NewConn(rdwr)}
+	for i := 0; i < 2*maxResultsLength/16; i++ {
+		s.addResult("0123456789", 1)
+	}
+	err := s.sendResults()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(buf)
+	var count int
+	var total string
+	for buf.Len() > 0 || reader.Buffered() > 0 {
+		// Note: no login occurred, hence the legacy framing is used
+		msg, err := protocol.ReadMessage(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msg.Content) > maxResultsLength {
+			t.Error("message is too long: ", len(msg.Content))
+		}
+		total += string(msg.Content)
+		count++
+	}
+	if count < 2 {
+		t.Error("results should have been split: ", count)
+	}
+	if total != strings.Join(s.results, "") {
+		t.Error("results were not correctly sent")
+	}
+}
+
+// freePort returns a port that was free when we checked.
+func freePort(t *testing.T) int {
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestSessionRecyclesDataPorts(t *testing.T) {
+	port := freePort(t)
+	tc := newCustomTestClient(t, func(s *Session) {
+		s.config.DataPortMin, s.config.DataPortMax = port, port
+	})
+	defer tc.conn.Close()
+	tc.login("22") // TestC2S | TestS2C | TestStatus
+	// Both tests use the only port in the range
+	tc.runC2S(50 * time.Millisecond)
+	tc.runS2C()
+	tc.send(protocol.MsgTest, "1234")
+	tc.readTestMsgs()
+	tc.logout()
+	s := <-tc.done
+	if len(s.ports.InUse(s.uuid)) != 0 {
+		t.Error("the data port was not released")
+	}
+}
+
+func TestSessionDataPortsExhausted(t *testing.T) {
+	port := freePort(t)
+	pa, err := netx.NewPortAllocator(port, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pa.Allocate("other session"); err != nil {
+		t.Fatal(err)
+	}
+	tc := newCustomTestClient(t, func(s *Session) {
+		s.config.DataPortMin, s.config.DataPortMax = port, port
+		s.ports = pa
+	})
+	defer tc.conn.Close()
+	tc.login("18") // TestC2S | TestStatus
+	// The session tells why it fails instead of announcing the data port
+	if msg := tc.expect(protocol.MsgError); msg != ErrNoDataPort.Error() {
+		t.Error("unexpected error message: ", msg)
+	}
+	if _, err := protocol.ReadMessage(tc.rdwr.Reader); err == nil {
+		t.Error("expected the control connection to be closed")
+	}
+	tc.waitSession(time.Second)
+	if pa.InUse("other session")[0] != port {
+		t.Error("the ports of other sessions should not be released")
+	}
+}
+
+func TestSessionOverIPv6(t *testing.T) {
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 is not available: ", err)
+	}
+	defer ln.Close()
+	done := make(chan *Session, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		s := NewSession(conn, testConfig())
+		s.Run()
+		done <- s
+	}()
+	tc := dialTestClient(t, ln.Addr().String())
+	defer tc.conn.Close()
+	tc.login("20") // TestS2C | TestStatus
+	port := tc.expect(protocol.MsgTestPrepare)
+	// The data listener only uses the address of the control connection
+	if conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", port)); err == nil {
+		conn.Close()
+		t.Fatal("the data listener should not accept IPv4 connections")
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort("::1", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.expect(protocol.MsgTestStart)
+	io.Copy(ioutil.Discard, conn)
+	conn.Close()
+	tc.expect(protocol.MsgTest)
+	tc.send(protocol.MsgTest, "1234")
+	tc.readTestMsgs()
+	tc.logout()
+	if r := (<-done).record(nil); r.IPFamily != "ipv6" {
+		t.Error("unexpected IP family: ", r.IPFamily)
+	}
+}
+
+func TestSessionSkipsDataPortsOfOtherProcesses(t *testing.T) {
+	// A draining server still listens on the port with SO_REUSEPORT
+	port := freePort(t)
+	ln, err := netx.NewTCPListenerWithOptions(":"+strconv.Itoa(port),
+		time.Time{}, netx.ListenOptions{ReusePort: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	tc := newCustomTestClient(t, func(s *Session) {
+		s.config.DataPortMin, s.config.DataPortMax = port, port
+		s.config.ReusePort = true
+	})
+	defer tc.conn.Close()
+	tc.login("18") // TestC2S | TestStatus
+	if msg := tc.expect(protocol.MsgError); msg != ErrNoDataPort.Error() {
+		t.Error("the session should not share the data port: ", msg)
+	}
+	tc.waitSession(time.Second)
+}
+
+func TestSessionWithoutUUID(t *testing.T) {
+	tc := newCustomTestClient(t, func(s *Session) {
+		s.uuid = "" // as if util.NewUUID failed
+	})
+	defer tc.conn.Close()
+	err := protocol.SendJSON(tc.rdwr.Writer, protocol.MsgExtendedLogin,
+		map[string]string{"msg": "v3.7.0", "tests": "18"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The session must not allocate resources shared by other sessions,
+	// hence it fails before replying.
+	data, _ := ioutil.ReadAll(tc.rdwr)
+	if len(data) != 0 {
+		t.Error("the server should not reply: ", string(data))
+	}
+	tc.waitSession(time.Second)
+}
@@ -0,0 +1,188 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/m-lab/ndt-server-go/netx"
+	"github.com/m-lab/ndt-server-go/protocol"
+)
+
+const (
+	// DefaultSFWTimeout is the default time that we allow to each
+	// direction of the simple firewall test to complete.
+	DefaultSFWTimeout = 3 * time.Second
+
+	// sfwMessage is the message exchanged during the firewall test.
+	sfwMessage = "Simple firewall test"
+)
+
+// ErrInvalidSFWPort is returned when the client advertises an invalid port
+// during the simple firewall test.
+var ErrInvalidSFWPort = errors.New("Invalid simple firewall test port")
+
+// sfwVerdict is the verdict of a simple firewall test direction. The
+// values are the ones sent to clients by the reference implementation.
+type sfwVerdict int
+
+const (
+	sfwNotTested  = sfwVerdict(0)
+	sfwOpen       = sfwVerdict(1)
+	sfwUnknown    = sfwVerdict(2)
+	sfwFirewalled = sfwVerdict(3)
+)
+
+func (v sfwVerdict) String() string {
+	switch v {
+	case sfwOpen:
+		return "open"
+	case sfwUnknown:
+		return "unknown"
+	case sfwFirewalled:
+		return "firewalled"
+	}
+	return "not tested"
+}
+
+// MarshalText allows to archive the verdict using its name.
+func (v sfwVerdict) MarshalText() ([]byte, error) {
+	return []byte(v.String()), nil
+}
+
+// isTimeout returns whether |err| is a timeout error.
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// sfwConnect connects to |address| and sends the firewall test message,
+// testing whether the server can reach the client.
+func (s *Session) sfwConnect(address string, timeout time.Duration) sfwVerdict {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if isTimeout(err) {
+		return sfwFirewalled
+	}
+	if err != nil {
+		log.Println("SFW: cannot connect to client:", err)
+		return sfwUnknown
+	}
+	defer conn.Close()
+	err = conn.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return sfwUnknown
+	}
+	wr := bufio.NewWriter(conn)
+	ctrl := s.ctrl.NewConnLike(bufio.NewReadWriter(bufio.NewReader(conn), wr))
+	err = ctrl.SendString(protocol.MsgTest, sfwMessage)
+	if err != nil {
+		log.Println("SFW: cannot send message to client:", err)
+		return sfwUnknown
+	}
+	return sfwOpen
+}
+
+// sfwAccept accepts a connection using |ln| and reads the firewall test
+// message, testing whether the client can reach the server. As for the
+// other data connections, trusted proxies must send a PROXY header.
+func (s *Session) sfwAccept(ln net.Listener, timeout time.Duration) sfwVerdict {
+	err := ln.(*net.TCPListener).SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return sfwUnknown
+	}
+	if len(s.proxies) > 0 {
+		ln = netx.NewProxyListener(ln, s.proxies)
+	}
+	conn, err := ln.Accept()
+	if isTimeout(err) {
+		return sfwFirewalled
+	}
+	if err != nil {
+		log.Println("SFW: cannot accept client connection:", err)
+		return sfwUnknown
+	}
+	defer conn.Close()
+	err = conn.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return sfwUnknown
+	}
+	if pc, ok := conn.(*netx.ProxyConn); ok {
+		_, err = pc.Header()
+		if err != nil {
+			log.Println("SFW: invalid PROXY header:", err)
+			return sfwUnknown
+		}
+	}
+	rd := bufio.NewReader(conn)
+	ctrl := s.ctrl.NewConnLike(bufio.NewReadWriter(rd, bufio.NewWriter(conn)))
+	msg, err := ctrl.ReadString(protocol.MsgTest)
+	if err != nil || msg != sfwMessage {
+		log.Println("SFW: did not receive the expected message:", err)
+		return sfwUnknown
+	}
+	return sfwOpen
+}
+
+// runSFW runs the simple firewall test. We announce a port and how long we
+// wait for the client to connect with "port timeout" (in seconds). The client
+// replies with the port on which it listens. Then, we try to connect to the
+// client and the client tries to connect to us. We tell the client whether
+// we received its message and we save the verdict of both directions.
+func runSFW(s *Session) error {
+	ln, port, err := s.listenData()
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	timeout := s.config.SFWTimeout
+	err = s.sendMsg(protocol.MsgTestPrepare, fmt.Sprintf("%d %d", port,
+		int((timeout+time.Second-1)/time.Second)))
+	if err != nil {
+		return err
+	}
+	msg, err := s.readMsg(protocol.MsgTest)
+	if err != nil {
+		return err
+	}
+	clientPort, err := strconv.Atoi(msg)
+	if err != nil || clientPort <= 0 || clientPort > 65535 {
+		return ErrInvalidSFWPort
+	}
+	host, _, err := net.SplitHostPort(s.conn.RemoteAddr().String())
+	if err != nil {
+		return err
+	}
+	err = s.sendMsg(protocol.MsgTestStart, "")
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	s2c, c2s := sfwNotTested, sfwNotTested
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		s2c = s.sfwConnect(net.JoinHostPort(host, msg), timeout)
+	}()
+	go func() {
+		defer wg.Done()
+		c2s = s.sfwAccept(ln, timeout)
+	}()
+	wg.Wait()
+
+	err = s.sendMsg(protocol.MsgTest, strconv.Itoa(int(c2s)))
+	if err != nil {
+		return err
+	}
+	s.addResult("SFWClientToServer", c2s)
+	s.addResult("SFWServerToClient", s2c)
+	return s.sendMsg(protocol.MsgTestFinalize, "")
+}
@@ -0,0 +1,127 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package server
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/m-lab/ndt-server-go/protocol"
+)
+
+// runSFW runs the client side of the simple firewall test. When |connect|
+// is false, the client does not connect to the server. When |listen| is
+// false, the client advertises a port on which nobody is listening.
+// Returns the verdict sent by the server.
+func (tc *testClient) runSFW(connect, listen bool) string {
+	fields := strings.Fields(tc.expect(protocol.MsgTestPrepare))
+	if len(fields) != 2 {
+		tc.t.Fatal("unexpected prepare message: ", fields)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+	if !listen {
+		ln.Close()
+	}
+	tc.send(protocol.MsgTest, strconv.Itoa(port))
+	tc.expect(protocol.MsgTestStart)
+
+	var wg sync.WaitGroup
+	if listen {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := ln.Accept()
+			if err != nil {
+				tc.t.Error(err)
+				return
+			}
+			defer conn.Close()
+			other := &testClient{t: tc.t, legacy: tc.legacy, rdwr: bufio.NewReadWriter(
+				bufio.NewReader(conn), bufio.NewWriter(conn))}
+			if msg := other.expect(protocol.MsgTest); msg != sfwMessage {
+				tc.t.Error("unexpected message: ", msg)
+			}
+		}()
+	}
+	if connect {
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", fields[0]))
+		if err != nil {
+			tc.t.Fatal(err)
+		}
+		defer conn.Close()
+		if tc.proxySource != "" {
+			sendProxyHeader(tc.t, conn, tc.proxySource, "192.0.2.1:"+fields[0])
+		}
+		other := &testClient{t: tc.t, legacy: tc.legacy, rdwr: bufio.NewReadWriter(
+			bufio.NewReader(conn), bufio.NewWriter(conn))}
+		other.send(protocol.MsgTest, sfwMessage)
+	}
+	wg.Wait()
+	verdict := tc.expect(protocol.MsgTest)
+	tc.expect(protocol.MsgTestFinalize)
+	return verdict
+}
+
+func TestSFW(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.conn.Close()
+	suite := tc.login("24")
+	if suite != "8" {
+		t.Fatal("unexpected tests suite: ", suite)
+	}
+	if verdict := tc.runSFW(true, true); verdict != "1" {
+		t.Error("unexpected verdict: ", verdict)
+	}
+	results := tc.logout()
+	if !strings.Contains(results, "SFWClientToServer: open\n") ||
+		!strings.Contains(results, "SFWServerToClient: open\n") {
+		t.Error("unexpected results: ", results)
+	}
+}
+
+func TestSFWLegacy(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.conn.Close()
+	tc.legacy = true
+	tc.login("24")
+	if verdict := tc.runSFW(true, true); verdict != "1" {
+		t.Error("unexpected verdict: ", verdict)
+	}
+	tc.logout()
+}
+
+func TestSFWFirewalled(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.conn.Close()
+	tc.login("24")
+	if verdict := tc.runSFW(false, false); verdict != "3" {
+		t.Error("unexpected verdict: ", verdict)
+	}
+	results := tc.logout()
+	if !strings.Contains(results, "SFWClientToServer: firewalled\n") ||
+		!strings.Contains(results, "SFWServerToClient: unknown\n") {
+		t.Error("unexpected results: ", results)
+	}
+}
+
+func TestSFWInvalidPort(t *testing.T) {
+	tc := newTestClient(t)
+	defer tc.conn.Close()
+	tc.login("24")
+	tc.expect(protocol.MsgTestPrepare)
+	tc.send(protocol.MsgTest, "65536")
+	_, err := protocol.ReadMessage(tc.rdwr.Reader)
+	if err == nil {
+		t.Error("the server should have closed the connection")
+	}
+}
@@ -0,0 +1,67 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package server
+
+import (
+	"fmt"
+
+	"github.com/m-lab/ndt-server-go/tcpinfo"
+)
+
+// web100Var is a variable named after the corresponding web100 variable,
+// which is what NDT clients expect to receive.
+type web100Var struct {
+	name  string
+	value uint64
+}
+
+// web100Vars maps |info| onto web100 variables. Times are converted from
+// microseconds to milliseconds and windows from segments to bytes.
+// CurRwinRcvd, the window advertised by the peer, is only reported when
+// the kernel returned tcpi_snd_wnd.
+func web100Vars(info *tcpinfo.TCPInfo) []web100Var {
+	mss := uint64(info.SndMSS)
+	vars := []web100Var{
+		{"CurMSS", mss},
+		{"CurRTO", uint64(info.RTO) / 1000},
+		{"SampleRTT", uint64(info.RTT) / 1000},
+		{"RTTVar", uint64(info.RTTVar) / 1000},
+		{"CurCwnd", uint64(info.SndCwnd) * mss},
+		{"CurSsthresh", uint64(info.SndSsthresh) * mss},
+	}
+	if info.Has(tcpinfo.FieldSndWnd) {
+		vars = append(vars, web100Var{"CurRwinRcvd", uint64(info.SndWnd)})
+	}
+	return append(vars, web100Var{"PktsRetrans", uint64(info.TotalRetrans)})
+}
+
+// formatWeb100Vars formats |vars| as "name: value" lines.
+func formatWeb100Vars(vars []web100Var) []string {
+	var lines []string
+	for _, v := range vars {
+		lines = append(lines, fmt.Sprintf("%s: %d\n", v.name, v.value))
+	}
+	return lines
+}
+
+// winScale returns the window scale we sent and the one we received,
+// or -1 if window scaling has not been negotiated.
+func winScale(info *tcpinfo.TCPInfo) (int, int) {
+	if info.Options&tcpinfo.OptWScale == 0 {
+		return -1, -1
+	}
+	// SndWScale is the scale announced by the peer, RcvWScale is the one
+	// we announced.
+	return int(info.RcvWScale), int(info.SndWScale)
+}
+
+// expectedMSS returns the tcpi_snd_mss we expect when |mss| is the MSS set
+// on the socket. The kernel subtracts from the MSS the space taken by the
+// timestamps option, if negotiated.
+func expectedMSS(info *tcpinfo.TCPInfo, mss uint32) uint32 {
+	if info.Options&tcpinfo.OptTimestamps != 0 {
+		return mss - 12
+	}
+	return mss
+}
@@ -0,0 +1,90 @@
+package tcpinfo
+
+// CCInfo contains the congestion control algorithm of a connection and,
+// for the algorithms exporting it, the TCP_CC_INFO of the algorithm.
+type CCInfo struct {
+	Algorithm string
+	BBR       *BBRInfo   `json:",omitempty"`
+	Vegas     *VegasInfo `json:",omitempty"`
+	DCTCP     *DCTCPInfo `json:",omitempty"`
+}
+
+// BBRInfo contains the estimates of BBR (struct tcp_bbr_info).
+type BBRInfo struct {
+	// Bandwidth is the estimated bottleneck bandwidth in bytes per second.
+	Bandwidth uint64
+	// MinRTT is the estimated minimum RTT in microseconds.
+	MinRTT uint32
+	// PacingGain and CwndGain are fixed point numbers scaled by 256.
+	PacingGain uint32
+	CwndGain   uint32
+}
+
+// VegasInfo contains the state of Vegas (struct tcpvegas_info), which is
+// also exported by Westwood and Illinois.
+type VegasInfo struct {
+	Enabled  uint32
+	RTTCount uint32
+	// RTT and MinRTT are in microseconds.
+	RTT    uint32
+	MinRTT uint32
+}
+
+// DCTCPInfo contains the state of DCTCP (struct tcp_dctcp_info).
+type DCTCPInfo struct {
+	Enabled uint16
+	CEState uint16
+	Alpha   uint32
+	ABECN   uint32
+	ABTot   uint32
+}
+
+// Sizes of the TCP_CC_INFO structs.
+const (
+	sizeofBBRInfo   = 20
+	sizeofVegasInfo = 16
+	sizeofDCTCPInfo = 16
+)
+
+// DecodeCCInfo decodes the TCP_CC_INFO returned by the kernel in |buf| for
+// a connection using |algorithm|. Only the algorithm is set if the kernel
+// did not return the expected struct.
+func DecodeCCInfo(algorithm string, buf []byte) *CCInfo {
+	order := nativeEndian
+	info := &CCInfo{Algorithm: algorithm}
+	switch algorithm {
+	case "bbr":
+		if len(buf) < sizeofBBRInfo {
+			break
+		}
+		info.BBR = &BBRInfo{
+			Bandwidth: uint64(order.Uint32(buf[4:]))<<32 |
+				uint64(order.Uint32(buf[0:])),
+			MinRTT:     order.Uint32(buf[8:]),
+			PacingGain: order.Uint32(buf[12:]),
+			CwndGain:   order.Uint32(buf[16:]),
+		}
+	case "vegas", "westwood", "illinois":
+		if len(buf) < sizeofVegasInfo {
+			break
+		}
+		info.Vegas = &VegasInfo{
+			Enabled:  order.Uint32(buf[0:]),
+			RTTCount: order.Uint32(buf[4:]),
+			RTT:      order.Uint32(buf[8:]),
+			MinRTT:   order.Uint32(buf[12:]),
+		}
+	case "dctcp":
+		if len(buf) < sizeofDCTCPInfo {
+			break
+		}
+		info.DCTCP = &DCTCPInfo{
+			Enabled: order.Uint16(buf[0:]),
+			CEState: order.Uint16(buf[2:]),
+			Alpha:   order.Uint32(buf[4:]),
+			ABECN:   order.Uint32(buf[8:]),
+			ABTot:   order.Uint32(buf[12:]),
+		}
+	}
+	return info
+}
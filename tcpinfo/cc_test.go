@@ -0,0 +1,51 @@
+package tcpinfo_test
+
+import (
+	"encoding/binary"
+	"runtime"
+	"testing"
+
+	"github.com/m-lab/ndt-server-go/tcpinfo"
+)
+
+func TestDecodeCCInfo(t *testing.T) {
+	switch runtime.GOARCH {
+	case "mips", "mips64", "ppc64", "s390x":
+		t.Skip("the test data is little endian")
+	}
+	buf := make([]byte, 20)
+	binary.LittleEndian.PutUint32(buf[0:], 1)     // bbr_bw_lo
+	binary.LittleEndian.PutUint32(buf[4:], 2)     // bbr_bw_hi
+	binary.LittleEndian.PutUint32(buf[8:], 15000) // bbr_min_rtt
+	binary.LittleEndian.PutUint32(buf[12:], 739)  // bbr_pacing_gain
+	binary.LittleEndian.PutUint32(buf[16:], 512)  // bbr_cwnd_gain
+	info := tcpinfo.DecodeCCInfo("bbr", buf)
+	if info.Algorithm != "bbr" || info.BBR == nil {
+		t.Fatalf("unexpected info: %+v", info)
+	}
+	if info.BBR.Bandwidth != 2<<32|1 || info.BBR.MinRTT != 15000 ||
+		info.BBR.PacingGain != 739 || info.BBR.CwndGain != 512 {
+		t.Errorf("unexpected BBR info: %+v", info.BBR)
+	}
+
+	info = tcpinfo.DecodeCCInfo("vegas", buf[:16])
+	if info.Vegas == nil || info.Vegas.Enabled != 1 || info.Vegas.MinRTT != 739 {
+		t.Errorf("unexpected Vegas info: %+v", info.Vegas)
+	}
+	info = tcpinfo.DecodeCCInfo("dctcp", buf[:16])
+	if info.DCTCP == nil || info.DCTCP.Enabled != 1 || info.DCTCP.Alpha != 2 {
+		t.Errorf("unexpected DCTCP info: %+v", info.DCTCP)
+	}
+}
+
+func TestDecodeCCInfoWithoutInfo(t *testing.T) {
+	info := tcpinfo.DecodeCCInfo("cubic", nil)
+	if info.Algorithm != "cubic" || info.BBR != nil || info.Vegas != nil ||
+		info.DCTCP != nil {
+		t.Errorf("unexpected info: %+v", info)
+	}
+	info = tcpinfo.DecodeCCInfo("bbr", make([]byte, 8))
+	if info.BBR != nil {
+		t.Error("a short buffer should not be decoded")
+	}
+}
@@ -0,0 +1,100 @@
+package tcpinfo_test
+
+import (
+	"encoding/binary"
+	"runtime"
+	"testing"
+
+	"github.com/m-lab/ndt-server-go/tcpinfo"
+)
+
+// fakeTCPInfo returns a little endian tcp_info with known values.
+func fakeTCPInfo() []byte {
+	buf := make([]byte, tcpinfo.MaxSize)
+	buf[0] = 1                                        // state
+	buf[5] = tcpinfo.OptWScale                        // options
+	buf[6] = 7<<4 | 9                                 // rcv_wscale, snd_wscale
+	buf[7] = 2<<1 | 1                                 // fastopen_client_fail, app_limited
+	binary.LittleEndian.PutUint32(buf[16:], 1448)     // snd_mss
+	binary.LittleEndian.PutUint32(buf[68:], 20000)    // rtt
+	binary.LittleEndian.PutUint32(buf[100:], 3)       // total_retrans
+	binary.LittleEndian.PutUint64(buf[104:], 1000000) // pacing_rate
+	binary.LittleEndian.PutUint32(buf[148:], 15000)   // min_rtt
+	binary.LittleEndian.PutUint64(buf[160:], 2000000) // delivery_rate
+	binary.LittleEndian.PutUint64(buf[208:], 4096)    // bytes_retrans
+	binary.LittleEndian.PutUint16(buf[242:], 5)       // total_rto_recoveries
+	binary.LittleEndian.PutUint32(buf[244:], 123)     // total_rto_time
+	return buf
+}
+
+func TestDecode(t *testing.T) {
+	switch runtime.GOARCH {
+	case "mips", "mips64", "ppc64", "s390x":
+		t.Skip("the test data is little endian")
+	}
+	info := tcpinfo.Decode(fakeTCPInfo())
+	if info.State != 1 || info.SndMSS != 1448 || info.RTT != 20000 ||
+		info.TotalRetrans != 3 || info.PacingRate != 1000000 ||
+		info.MinRTT != 15000 || info.DeliveryRate != 2000000 ||
+		info.BytesRetrans != 4096 || info.TotalRTORecoveries != 5 ||
+		info.TotalRTOTime != 123 {
+		t.Errorf("unexpected values: %+v", info)
+	}
+	if info.SndWScale != 9 || info.RcvWScale != 7 {
+		t.Error("unexpected window scales: ", info.SndWScale, info.RcvWScale)
+	}
+	if !info.DeliveryRateAppLimited || info.FastOpenClientFail != 2 {
+		t.Error("unexpected bit fields: ", info.DeliveryRateAppLimited,
+			info.FastOpenClientFail)
+	}
+	if !info.Has(tcpinfo.FieldState) || !info.Has(tcpinfo.FieldTotalRTOTime) {
+		t.Errorf("all fields should be present: %x", info.Present)
+	}
+}
+
+func TestDecodeShortInfo(t *testing.T) {
+	// 104 bytes is the size of tcp_info in older kernels
+	info := tcpinfo.Decode(fakeTCPInfo()[:104])
+	if !info.Has(tcpinfo.FieldTotalRetrans) || info.TotalRetrans != 3 {
+		t.Error("total_retrans should be present")
+	}
+	if info.Has(tcpinfo.FieldPacingRate) || info.PacingRate != 0 {
+		t.Error("pacing_rate should not be present")
+	}
+	// A field must be entirely in the buffer to be present
+	info = tcpinfo.Decode(fakeTCPInfo()[:110])
+	if info.Has(tcpinfo.FieldPacingRate) || info.PacingRate != 0 {
+		t.Error("truncated pacing_rate should not be present")
+	}
+	info = tcpinfo.Decode(nil)
+	if info.Present != 0 {
+		t.Errorf("no field should be present: %x", info.Present)
+	}
+}
+
+func TestDecodeLongInfo(t *testing.T) {
+	buf := append(fakeTCPInfo(), make([]byte, 64)...)
+	info := tcpinfo.Decode(buf)
+	if !info.Has(tcpinfo.FieldTotalRTOTime) {
+		t.Error("known fields should be decoded from longer buffers")
+	}
+}
+
+func TestTCPInfo2PresentFields(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("TCP_INFO is only supported on Linux")
+	}
+	conn, cleanup := dialLoopback(t)
+	defer cleanup()
+	info, err := tcpinfo.TCPInfo2(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// All the kernels we support return at least the old struct
+	if !info.Has(tcpinfo.FieldTotalRetrans) || info.SndMSS == 0 {
+		t.Errorf("unexpected TCP_INFO: %+v", info)
+	}
+	if info.State != 1 { // TCP_ESTABLISHED
+		t.Error("unexpected state: ", info.State)
+	}
+}
@@ -0,0 +1,200 @@
+package tcpinfo
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SocketID is the 4-tuple of a TCP socket. Addresses are formatted like
+// net.TCPAddr.String(), hence the SocketID of a connection can be built
+// from its local and remote addresses.
+type SocketID struct {
+	Local  string
+	Remote string
+}
+
+// NewSocketID returns the SocketID of a connection from |local| to |remote|.
+func NewSocketID(local, remote net.Addr) SocketID {
+	return SocketID{Local: local.String(), Remote: remote.String()}
+}
+
+// newSocketID returns the SocketID of the socket with the given addresses.
+func newSocketID(localIP net.IP, localPort int, remoteIP net.IP,
+	remotePort int) SocketID {
+	return SocketID{
+		Local:  net.JoinHostPort(localIP.String(), strconv.Itoa(localPort)),
+		Remote: net.JoinHostPort(remoteIP.String(), strconv.Itoa(remotePort)),
+	}
+}
+
+// MemInfo contains the memory used by a socket (struct inet_diag_meminfo).
+type MemInfo struct {
+	RMem uint32
+	WMem uint32
+	FMem uint32
+	TMem uint32
+}
+
+// SKMemInfo contains the detailed memory usage of a socket, as returned by
+// the SO_MEMINFO socket option.
+type SKMemInfo struct {
+	RMemAlloc  uint32
+	RcvBuf     uint32
+	WMemAlloc  uint32
+	SndBuf     uint32
+	FwdAlloc   uint32
+	WMemQueued uint32
+	OptMem     uint32
+	Backlog    uint32
+	Drops      uint32
+}
+
+// DiagSocket is the state of a TCP socket returned by sock_diag. The
+// pointers are nil if the kernel did not return the corresponding info,
+// e.g. for sockets in TIME_WAIT.
+type DiagSocket struct {
+	ID     SocketID
+	State  uint8
+	UID    uint32
+	Inode  uint32
+	RQueue uint32
+	WQueue uint32
+
+	MemInfo   *MemInfo   `json:",omitempty"`
+	SKMemInfo *SKMemInfo `json:",omitempty"`
+	TCPInfo   *TCPInfo   `json:",omitempty"`
+	CCInfo    *CCInfo    `json:",omitempty"`
+}
+
+// DiagSample is a DiagSocket collected at Time.
+type DiagSample struct {
+	Time   time.Time
+	Socket *DiagSocket
+}
+
+// Collector periodically dumps the TCP sockets using sock_diag and keeps
+// the state of the sockets registered by their owners. Since the kernel
+// keeps closed sockets until they are fully shut down, owners can collect
+// the state of sockets they have already closed.
+type Collector struct {
+	capacity int
+
+	mu      sync.Mutex
+	owners  map[SocketID]string
+	samples map[string][]DiagSample
+
+	once sync.Once
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewCollector creates a Collector keeping at most |capacity| samples per
+// owner. If |interval| is positive, the Collector dumps the sockets every
+// |interval| until Stop is called. Otherwise, sockets are only dumped when
+// Collect is called.
+func NewCollector(interval time.Duration, capacity int) (*Collector, error) {
+	if capacity <= 0 {
+		return nil, ErrInvalidCapacity
+	}
+	c := &Collector{
+		capacity: capacity,
+		owners:   make(map[SocketID]string),
+		samples:  make(map[string][]DiagSample),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if interval <= 0 {
+		close(c.done)
+		return c, nil
+	}
+	go c.run(interval)
+	return c, nil
+}
+
+// run calls Collect every |interval| until the Collector is stopped.
+func (c *Collector) run(interval time.Duration) {
+	defer close(c.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			// Errors are reported to the callers of Collect.
+			c.Collect()
+		}
+	}
+}
+
+// Register starts collecting the state of the socket |id| on behalf of
+// |owner|.
+func (c *Collector) Register(owner string, id SocketID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.owners[id] = owner
+}
+
+// Collect dumps the registered sockets once and adds their state to the
+// samples of their owners.
+func (c *Collector) Collect() error {
+	c.mu.Lock()
+	ports := make(map[int]bool)
+	for id := range c.owners {
+		_, port, err := net.SplitHostPort(id.Local)
+		if err != nil {
+			continue
+		}
+		if p, err := strconv.Atoi(port); err == nil {
+			ports[p] = true
+		}
+	}
+	c.mu.Unlock()
+	if len(ports) <= 0 {
+		return nil
+	}
+	sockets, err := DumpTCP(ports)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, socket := range sockets {
+		owner, ok := c.owners[socket.ID]
+		if !ok {
+			continue
+		}
+		samples := append(c.samples[owner], DiagSample{now, socket})
+		if len(samples) > c.capacity {
+			samples = samples[len(samples)-c.capacity:]
+		}
+		c.samples[owner] = samples
+	}
+	return nil
+}
+
+// Take returns the samples collected on behalf of |owner| and forgets
+// both the samples and the sockets of |owner|.
+func (c *Collector) Take(owner string) []DiagSample {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	samples := c.samples[owner]
+	delete(c.samples, owner)
+	for id, o := range c.owners {
+		if o == owner {
+			delete(c.owners, id)
+		}
+	}
+	return samples
+}
+
+// Stop stops the periodic collection. Stop can be called more than once.
+func (c *Collector) Stop() {
+	c.once.Do(func() {
+		close(c.stop)
+	})
+	<-c.done
+}
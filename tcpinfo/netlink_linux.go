@@ -0,0 +1,270 @@
+package tcpinfo
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"syscall"
+)
+
+// Constants of linux/sock_diag.h and linux/inet_diag.h, which syscall lacks.
+const (
+	sockDiagByFamily = 20
+
+	inetDiagMemInfo   = 1
+	inetDiagInfo      = 2
+	inetDiagVegasInfo = 3
+	inetDiagCong      = 4
+	inetDiagSKMemInfo = 7
+	inetDiagDCTCPInfo = 9
+	inetDiagBBRInfo   = 16
+
+	inetDiagReqBytecode = 1
+	inetDiagBCJmp       = 1
+	inetDiagBCSGE       = 2
+	inetDiagBCSLE       = 3
+
+	sizeofInetDiagReqV2 = 56
+	sizeofBCOp          = 4
+	sizeofInetDiagMsg   = 72
+	sizeofMemInfo       = 16
+	sizeofSKMemInfo     = 36
+)
+
+// diagExtensions are the extensions we request. Requesting the Vegas info
+// also returns the DCTCP and BBR info.
+const diagExtensions = 1<<(inetDiagMemInfo-1) | 1<<(inetDiagInfo-1) |
+	1<<(inetDiagVegasInfo-1) | 1<<(inetDiagCong-1) | 1<<(inetDiagSKMemInfo-1)
+
+// diagTimeout bounds the time we wait for the kernel to answer.
+var diagTimeout = syscall.Timeval{Sec: 5}
+
+// sizeofPortMatch is the size of the bytecode matching a source port.
+const sizeofPortMatch = 5 * sizeofBCOp
+
+// maxFilterPorts is the maximum number of ports of a bytecode filter, whose
+// jumps and attribute length are 16 bits.
+const maxFilterPorts = (0xffff - syscall.SizeofRtAttr) / sizeofPortMatch
+
+// ErrInvalidDiagMsg is returned when the kernel returns a message that we
+// cannot parse.
+var ErrInvalidDiagMsg = errors.New("Invalid inet_diag message")
+
+// DumpTCP returns the state of the IPv4 and IPv6 TCP sockets whose local
+// port is in |ports|, or of all the TCP sockets if |ports| is empty. The
+// sockets of each family are dumped with a single netlink request, which
+// the kernel filters by local port unless there are too many ports.
+func DumpTCP(ports map[int]bool) ([]*DiagSocket, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK,
+		syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, syscall.NETLINK_INET_DIAG)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	defer syscall.Close(fd)
+	err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO,
+		&diagTimeout)
+	if err != nil {
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+	var filter []byte
+	if len(ports) <= maxFilterPorts {
+		filter = portFilter(ports)
+	}
+	var sockets []*DiagSocket
+	for seq, family := range []uint8{syscall.AF_INET, syscall.AF_INET6} {
+		err = dumpFamily(fd, family, uint32(seq+1), filter, func(s *DiagSocket) {
+			_, port, _ := net.SplitHostPort(s.ID.Local)
+			p, _ := strconv.Atoi(port)
+			if filter == nil && len(ports) > 0 && !ports[p] {
+				return
+			}
+			sockets = append(sockets, s)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sockets, nil
+}
+
+// portFilter returns the inet_diag bytecode matching the sockets whose
+// source port is in |ports|, or nil if |ports| is empty. For each port, the
+// bytecode checks sport >= port and sport <= port, then jumps to the end,
+// which accepts the socket. Failed checks continue with the next port or,
+// for the last one, jump past the end, which rejects the socket. The kernel
+// requires the success branches to follow each other.
+func portFilter(ports map[int]bool) []byte {
+	var sorted []int
+	for port := range ports {
+		sorted = append(sorted, port)
+	}
+	sort.Ints(sorted)
+	bc := make([]byte, len(sorted)*sizeofPortMatch)
+	op := func(off int, code uint8, yes uint8, no int) {
+		bc[off] = code
+		bc[off+1] = yes
+		nativeEndian.PutUint16(bc[off+2:], uint16(no))
+	}
+	for i, port := range sorted {
+		off := i * sizeofPortMatch
+		next := off + sizeofPortMatch
+		if next == len(bc) {
+			next += sizeofBCOp // reject
+		}
+		op(off, inetDiagBCSGE, 2*sizeofBCOp, next-off)
+		op(off+4, 0, 0, port)
+		op(off+8, inetDiagBCSLE, 2*sizeofBCOp, next-off-8)
+		op(off+12, 0, 0, port)
+		op(off+16, inetDiagBCJmp, sizeofBCOp, len(bc)-off-16)
+	}
+	return bc
+}
+
+// dumpFamily dumps the TCP sockets of |family| matching the bytecode
+// |filter|, if any, using the netlink socket |fd| and calls |fn| for each
+// of them.
+func dumpFamily(fd int, family uint8, seq uint32, filter []byte, fn func(*DiagSocket)) error {
+	size := syscall.NLMSG_HDRLEN + sizeofInetDiagReqV2
+	if len(filter) > 0 {
+		size += syscall.SizeofRtAttr + len(filter)
+	}
+	req := make([]byte, size)
+	nativeEndian.PutUint32(req[0:], uint32(len(req)))
+	nativeEndian.PutUint16(req[4:], sockDiagByFamily)
+	nativeEndian.PutUint16(req[6:], syscall.NLM_F_REQUEST|syscall.NLM_F_DUMP)
+	nativeEndian.PutUint32(req[8:], seq)
+	body := req[syscall.NLMSG_HDRLEN:]
+	body[0] = family
+	body[1] = syscall.IPPROTO_TCP
+	body[2] = diagExtensions
+	nativeEndian.PutUint32(body[4:], 0xffffffff) // all states
+	if len(filter) > 0 {
+		attr := body[sizeofInetDiagReqV2:]
+		nativeEndian.PutUint16(attr[0:], uint16(syscall.SizeofRtAttr+len(filter)))
+		nativeEndian.PutUint16(attr[2:], inetDiagReqBytecode)
+		copy(attr[syscall.SizeofRtAttr:], filter)
+	}
+	err := syscall.Sendto(fd, req, 0, &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+	})
+	if err != nil {
+		return os.NewSyscallError("sendto", err)
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return os.NewSyscallError("recvfrom", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != seq {
+				continue
+			}
+			switch m.Header.Type {
+			case syscall.NLMSG_DONE:
+				return nil
+			case syscall.NLMSG_ERROR:
+				if len(m.Data) < 4 {
+					return ErrInvalidDiagMsg
+				}
+				errno := int32(nativeEndian.Uint32(m.Data))
+				return os.NewSyscallError("inet_diag", syscall.Errno(-errno))
+			case sockDiagByFamily:
+				s, err := parseDiagMsg(m.Data)
+				if err != nil {
+					return err
+				}
+				fn(s)
+			}
+		}
+	}
+}
+
+// parseDiagMsg parses a struct inet_diag_msg followed by its attributes.
+func parseDiagMsg(data []byte) (*DiagSocket, error) {
+	if len(data) < sizeofInetDiagMsg {
+		return nil, ErrInvalidDiagMsg
+	}
+	ipLen := net.IPv4len
+	if data[0] == syscall.AF_INET6 {
+		ipLen = net.IPv6len
+	}
+	// Ports and addresses are in network byte order
+	s := &DiagSocket{
+		ID: newSocketID(
+			net.IP(append([]byte(nil), data[8:8+ipLen]...)),
+			int(binary.BigEndian.Uint16(data[4:])),
+			net.IP(append([]byte(nil), data[24:24+ipLen]...)),
+			int(binary.BigEndian.Uint16(data[6:]))),
+		State:  data[1],
+		RQueue: nativeEndian.Uint32(data[56:]),
+		WQueue: nativeEndian.Uint32(data[60:]),
+		UID:    nativeEndian.Uint32(data[64:]),
+		Inode:  nativeEndian.Uint32(data[68:]),
+	}
+
+	var cong string
+	var ccInfo []byte
+	attrs := data[sizeofInetDiagMsg:]
+	for len(attrs) >= syscall.SizeofRtAttr {
+		attrLen := int(nativeEndian.Uint16(attrs[0:]))
+		attrType := nativeEndian.Uint16(attrs[2:])
+		if attrLen < syscall.SizeofRtAttr || attrLen > len(attrs) {
+			return nil, ErrInvalidDiagMsg
+		}
+		value := attrs[syscall.SizeofRtAttr:attrLen]
+		switch attrType {
+		case inetDiagMemInfo:
+			if len(value) >= sizeofMemInfo {
+				s.MemInfo = &MemInfo{
+					RMem: nativeEndian.Uint32(value[0:]),
+					WMem: nativeEndian.Uint32(value[4:]),
+					FMem: nativeEndian.Uint32(value[8:]),
+					TMem: nativeEndian.Uint32(value[12:]),
+				}
+			}
+		case inetDiagSKMemInfo:
+			if len(value) >= sizeofSKMemInfo {
+				s.SKMemInfo = &SKMemInfo{
+					RMemAlloc:  nativeEndian.Uint32(value[0:]),
+					RcvBuf:     nativeEndian.Uint32(value[4:]),
+					WMemAlloc:  nativeEndian.Uint32(value[8:]),
+					SndBuf:     nativeEndian.Uint32(value[12:]),
+					FwdAlloc:   nativeEndian.Uint32(value[16:]),
+					WMemQueued: nativeEndian.Uint32(value[20:]),
+					OptMem:     nativeEndian.Uint32(value[24:]),
+					Backlog:    nativeEndian.Uint32(value[28:]),
+					Drops:      nativeEndian.Uint32(value[32:]),
+				}
+			}
+		case inetDiagInfo:
+			s.TCPInfo = Decode(value)
+		case inetDiagCong:
+			cong = cString(value)
+		case inetDiagVegasInfo, inetDiagDCTCPInfo, inetDiagBBRInfo:
+			ccInfo = value
+		}
+		next := rtaAlign(attrLen)
+		if next >= len(attrs) {
+			break
+		}
+		attrs = attrs[next:]
+	}
+	if cong != "" {
+		s.CCInfo = DecodeCCInfo(cong, ccInfo)
+	}
+	return s, nil
+}
+
+// rtaAlign rounds |n| up to the alignment of netlink attributes.
+func rtaAlign(n int) int {
+	return (n + syscall.RTA_ALIGNTO - 1) &^ (syscall.RTA_ALIGNTO - 1)
+}
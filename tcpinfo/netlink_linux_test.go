@@ -0,0 +1,118 @@
+package tcpinfo_test
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server-go/tcpinfo"
+)
+
+func TestDumpTCP(t *testing.T) {
+	conn, cleanup := dialLoopback(t)
+	defer cleanup()
+	id := tcpinfo.NewSocketID(conn.LocalAddr(), conn.RemoteAddr())
+	port := conn.LocalAddr().(*net.TCPAddr).Port
+	sockets, err := tcpinfo.DumpTCP(map[int]bool{port: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found *tcpinfo.DiagSocket
+	for _, s := range sockets {
+		_, p, _ := net.SplitHostPort(s.ID.Local)
+		if p != strconv.Itoa(port) {
+			t.Error("unexpected socket: ", s.ID)
+		}
+		if s.ID == id {
+			found = s
+		}
+	}
+	if found == nil {
+		t.Fatal("socket not found: ", id, sockets)
+	}
+	if found.State != 1 || found.TCPInfo == nil || found.TCPInfo.SndMSS == 0 {
+		t.Errorf("unexpected socket state: %+v", found)
+	}
+	if found.CCInfo == nil || found.CCInfo.Algorithm == "" {
+		t.Error("missing congestion control: ", found.CCInfo)
+	}
+	if found.MemInfo == nil || found.SKMemInfo == nil || found.SKMemInfo.SndBuf == 0 {
+		t.Error("missing memory info: ", found.MemInfo, found.SKMemInfo)
+	}
+}
+
+func TestDumpTCPFiltersPorts(t *testing.T) {
+	ports := make(map[int]bool)
+	ids := make(map[tcpinfo.SocketID]bool)
+	for i := 0; i < 3; i++ {
+		conn, cleanup := dialLoopback(t)
+		defer cleanup()
+		if i == 1 {
+			continue // not requested
+		}
+		ports[conn.LocalAddr().(*net.TCPAddr).Port] = true
+		ids[tcpinfo.NewSocketID(conn.LocalAddr(), conn.RemoteAddr())] = true
+	}
+	sockets, err := tcpinfo.DumpTCP(ports)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The local ports are ephemeral, hence only our sockets use them
+	if len(sockets) != len(ids) {
+		t.Fatal("unexpected number of sockets: ", len(sockets))
+	}
+	for _, s := range sockets {
+		if !ids[s.ID] {
+			t.Error("unexpected socket: ", s.ID)
+		}
+	}
+}
+
+func TestCollector(t *testing.T) {
+	c, err := tcpinfo.NewCollector(10*time.Millisecond, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	conn, cleanup := dialLoopback(t)
+	defer cleanup()
+	id := tcpinfo.NewSocketID(conn.LocalAddr(), conn.RemoteAddr())
+	c.Register("session", id)
+	time.Sleep(100 * time.Millisecond)
+	// The socket is still known by the kernel after being closed
+	conn.Close()
+	if err := c.Collect(); err != nil {
+		t.Fatal(err)
+	}
+	samples := c.Take("session")
+	if len(samples) != 3 {
+		t.Fatal("unexpected number of samples: ", len(samples))
+	}
+	for _, sample := range samples {
+		if sample.Socket.ID != id {
+			t.Error("unexpected socket: ", sample.Socket.ID)
+		}
+	}
+	if last := samples[len(samples)-1].Socket; last.State == 1 {
+		t.Error("the closed socket should not be established")
+	}
+	if samples := c.Take("session"); len(samples) != 0 {
+		t.Error("samples should have been forgotten: ", samples)
+	}
+}
+
+func TestCollectorWithoutSockets(t *testing.T) {
+	c, err := tcpinfo.NewCollector(0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Collect(); err != nil {
+		t.Error(err)
+	}
+	c.Stop()
+	c.Stop()
+	if _, err := tcpinfo.NewCollector(0, 0); err != tcpinfo.ErrInvalidCapacity {
+		t.Error("expected ErrInvalidCapacity, got: ", err)
+	}
+}
@@ -0,0 +1,128 @@
+package tcpinfo
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrInvalidInterval = errors.New("Sampling interval must be positive")
+	ErrInvalidCapacity = errors.New("Sampler capacity must be positive")
+)
+
+// Sample is a TCP_INFO snapshot taken at Time.
+type Sample struct {
+	Time time.Time
+	Info *TCPInfo
+}
+
+// Sampler periodically reads TCP_INFO from a connection in a background
+// goroutine and keeps the most recent samples in a ring buffer.
+type Sampler struct {
+	rc       syscall.RawConn
+	interval time.Duration
+
+	mu      sync.Mutex
+	samples []Sample
+	next    int
+	full    bool
+	dropped int
+	err     error
+
+	once sync.Once
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewSampler starts sampling TCP_INFO from |conn| every |interval|, keeping
+// at most |capacity| samples. When the buffer is full, the oldest samples
+// are overwritten. Sampling continues until Stop is called or reading
+// TCP_INFO fails, e.g. because |conn| has been closed. Sampling does not
+// duplicate the file descriptor of |conn|.
+func NewSampler(conn *net.TCPConn, interval time.Duration,
+	capacity int) (*Sampler, error) {
+	if interval <= 0 {
+		return nil, ErrInvalidInterval
+	}
+	if capacity <= 0 {
+		return nil, ErrInvalidCapacity
+	}
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	s := &Sampler{
+		rc:       rc,
+		interval: interval,
+		samples:  make([]Sample, capacity),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// run takes a sample immediately and then once every interval.
+func (s *Sampler) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for s.sample() {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sample reads TCP_INFO and stores it. Returns false if reading failed.
+func (s *Sampler) sample() bool {
+	info, err := RawTCPInfo(s.rc)
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.err = err
+		return false
+	}
+	if s.full {
+		s.dropped++
+	}
+	s.samples[s.next] = Sample{Time: now, Info: info}
+	s.next++
+	if s.next >= len(s.samples) {
+		s.next = 0
+		s.full = true
+	}
+	return true
+}
+
+// Stop stops sampling and returns the samples in chronological order and
+// the error that stopped sampling early, if any. Stop can be called more
+// than once.
+func (s *Sampler) Stop() ([]Sample, error) {
+	s.once.Do(func() {
+		close(s.stop)
+	})
+	<-s.done
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.full {
+		return append([]Sample(nil), s.samples[:s.next]...), s.err
+	}
+	series := make([]Sample, 0, len(s.samples))
+	series = append(series, s.samples[s.next:]...)
+	return append(series, s.samples[:s.next]...), s.err
+}
+
+// Dropped returns the number of samples overwritten because the buffer
+// was full.
+func (s *Sampler) Dropped() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
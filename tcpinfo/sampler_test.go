@@ -0,0 +1,98 @@
+package tcpinfo_test
+
+import (
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m-lab/ndt-server-go/tcpinfo"
+)
+
+// dialLoopback returns a connection to a loopback listener. The returned
+// function closes both ends.
+func dialLoopback(t testing.TB) (*net.TCPConn, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	var peer net.Conn
+	go func() {
+		defer wg.Done()
+		peer, _ = ln.Accept()
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	return conn.(*net.TCPConn), func() {
+		conn.Close()
+		if peer != nil {
+			peer.Close()
+		}
+		ln.Close()
+	}
+}
+
+func TestSamplerKeepsRecentSamples(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("TCP_INFO is only supported on Linux")
+	}
+	conn, cleanup := dialLoopback(t)
+	defer cleanup()
+	s, err := tcpinfo.NewSampler(conn, 5*time.Millisecond, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	series, err := s.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 4 {
+		t.Fatal("unexpected number of samples: ", len(series))
+	}
+	if s.Dropped() <= 0 {
+		t.Error("old samples should have been dropped")
+	}
+	for i, sample := range series {
+		if sample.Info == nil {
+			t.Fatal("missing TCP_INFO in sample ", i)
+		}
+		if i > 0 && !series[i-1].Time.Before(sample.Time) {
+			t.Error("samples are not in chronological order")
+		}
+	}
+	// Stop can be called again and returns the same series
+	again, _ := s.Stop()
+	if len(again) != len(series) || again[0].Time != series[0].Time {
+		t.Error("unexpected series after second Stop")
+	}
+}
+
+func TestSamplerStopsOnError(t *testing.T) {
+	conn, cleanup := dialLoopback(t)
+	defer cleanup()
+	conn.Close()
+	s, err := tcpinfo.NewSampler(conn, time.Millisecond, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	series, err := s.Stop()
+	if err == nil || len(series) != 0 {
+		t.Error("sampling a closed connection should fail: ", err, series)
+	}
+}
+
+func TestSamplerInvalidArguments(t *testing.T) {
+	if _, err := tcpinfo.NewSampler(nil, 0, 1); err != tcpinfo.ErrInvalidInterval {
+		t.Error("expected ErrInvalidInterval, got: ", err)
+	}
+	if _, err := tcpinfo.NewSampler(nil, time.Second, 0); err != tcpinfo.ErrInvalidCapacity {
+		t.Error("expected ErrInvalidCapacity, got: ", err)
+	}
+}
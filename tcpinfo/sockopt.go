@@ -0,0 +1,205 @@
+package tcpinfo
+
+import (
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// UnsupportedError is returned when a feature is not supported on the
+// running platform.
+type UnsupportedError struct {
+	What string
+}
+
+func (e *UnsupportedError) Error() string {
+	return e.What + " is not supported on " + runtime.GOOS
+}
+
+// IsUnsupported returns whether |err| is an UnsupportedError.
+func IsUnsupported(err error) bool {
+	_, ok := err.(*UnsupportedError)
+	return ok
+}
+
+// SockOpt is a socket option that can be set on both listeners and
+// connections. Connections accepted by a listener inherit its options.
+type SockOpt int
+
+// The socket options we support. Not all of them are available on all
+// platforms.
+const (
+	// SockOptMSS is TCP_MAXSEG, the maximum segment size in bytes.
+	SockOptMSS SockOpt = iota
+	// SockOptSndBuf is SO_SNDBUF, the send buffer size in bytes. Linux
+	// doubles the requested size to account for bookkeeping overhead.
+	SockOptSndBuf
+	// SockOptRcvBuf is SO_RCVBUF, the receive buffer size in bytes.
+	SockOptRcvBuf
+	// SockOptNoDelay is TCP_NODELAY, where non-zero disables Nagle.
+	SockOptNoDelay
+	// SockOptNotSentLowat is TCP_NOTSENT_LOWAT, the amount of unsent data
+	// in bytes above which the socket is not writable.
+	SockOptNotSentLowat
+	// SockOptMaxPacingRate is SO_MAX_PACING_RATE in bytes per second, or
+	// UnlimitedPacingRate, the default, when pacing is not limited.
+	SockOptMaxPacingRate
+	// SockOptUserTimeout is TCP_USER_TIMEOUT in milliseconds.
+	SockOptUserTimeout
+)
+
+// sockOptNames contains the names of the socket options.
+var sockOptNames = map[SockOpt]string{
+	SockOptMSS:           "TCP_MAXSEG",
+	SockOptSndBuf:        "SO_SNDBUF",
+	SockOptRcvBuf:        "SO_RCVBUF",
+	SockOptNoDelay:       "TCP_NODELAY",
+	SockOptNotSentLowat:  "TCP_NOTSENT_LOWAT",
+	SockOptMaxPacingRate: "SO_MAX_PACING_RATE",
+	SockOptUserTimeout:   "TCP_USER_TIMEOUT",
+}
+
+func (opt SockOpt) String() string {
+	if name, ok := sockOptNames[opt]; ok {
+		return name
+	}
+	return "unknown socket option"
+}
+
+// UnlimitedPacingRate is the value of SockOptMaxPacingRate when pacing is
+// not limited. The kernel represents it as ~0 on 64 bits.
+const UnlimitedPacingRate = int(^uint(0) >> 1)
+
+// wideSockOpts contains the socket options whose value is 64-bit wide.
+// Reading them with a 32-bit buffer truncates their value.
+var wideSockOpts = map[SockOpt]bool{SockOptMaxPacingRate: true}
+
+// AllSockOpts contains all the socket options, in order.
+var AllSockOpts = []SockOpt{SockOptMSS, SockOptSndBuf, SockOptRcvBuf,
+	SockOptNoDelay, SockOptNotSentLowat, SockOptMaxPacingRate,
+	SockOptUserTimeout}
+
+// sockOptLevel is the level and name used by setsockopt for an option.
+type sockOptLevel struct {
+	level int
+	name  int
+}
+
+// control runs |fn| on the file descriptor of |rc|. Unlike File(), this
+// neither duplicates the descriptor nor switches it to blocking mode.
+// Returns the error returned by |fn| or by |rc|.
+func control(rc syscall.RawConn, fn func(fd uintptr) error) error {
+	var ferr error
+	err := rc.Control(func(fd uintptr) {
+		ferr = fn(fd)
+	})
+	if err != nil {
+		return err
+	}
+	return ferr
+}
+
+// lookupSockOpt returns the level and name of |opt| on this platform.
+func lookupSockOpt(opt SockOpt) (sockOptLevel, error) {
+	l, ok := sockOptLevels[opt]
+	if !ok {
+		return sockOptLevel{}, &UnsupportedError{What: opt.String()}
+	}
+	return l, nil
+}
+
+// SetSockOpt sets |opt| to |value| on |conn|, which may be a listener.
+func SetSockOpt(conn syscall.Conn, opt SockOpt, value int) error {
+	l, err := lookupSockOpt(opt)
+	if err != nil {
+		return err
+	}
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return control(rc, func(fd uintptr) error {
+		if wideSockOpts[opt] {
+			wide := uint64(value)
+			if value == UnlimitedPacingRate {
+				wide = ^uint64(0)
+			}
+			return setSockOptUint64(fd, l, wide)
+		}
+		err := syscall.SetsockoptInt(int(fd), l.level, l.name, value)
+		return os.NewSyscallError("setsockopt", err)
+	})
+}
+
+// GetSockOpt returns the value of |opt| on |conn|, which may be a listener.
+func GetSockOpt(conn syscall.Conn, opt SockOpt) (int, error) {
+	l, err := lookupSockOpt(opt)
+	if err != nil {
+		return 0, err
+	}
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var value int
+	err = control(rc, func(fd uintptr) error {
+		var err error
+		if wideSockOpts[opt] {
+			var wide uint64
+			wide, err = getSockOptUint64(fd, l)
+			value = UnlimitedPacingRate
+			if wide < uint64(UnlimitedPacingRate) {
+				value = int(wide)
+			}
+			return err
+		}
+		value, err = syscall.GetsockoptInt(int(fd), l.level, l.name)
+		return os.NewSyscallError("getsockopt", err)
+	})
+	return value, err
+}
+
+// SetSockOpts sets all the |opts| on |conn| and returns the effective
+// values read back from the kernel, which may differ from the requested
+// ones. Stops at the first error.
+func SetSockOpts(conn syscall.Conn, opts map[SockOpt]int) (map[SockOpt]int, error) {
+	effective := make(map[SockOpt]int)
+	for _, opt := range AllSockOpts {
+		value, ok := opts[opt]
+		if !ok {
+			continue
+		}
+		err := SetSockOpt(conn, opt, value)
+		if err != nil {
+			return nil, err
+		}
+		effective[opt], err = GetSockOpt(conn, opt)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return effective, nil
+}
+
+// GetSockOpts returns the values of all the socket options supported on
+// this platform.
+func GetSockOpts(conn syscall.Conn) (map[SockOpt]int, error) {
+	values := make(map[SockOpt]int)
+	for _, opt := range AllSockOpts {
+		if _, ok := sockOptLevels[opt]; !ok {
+			continue
+		}
+		value, err := GetSockOpt(conn, opt)
+		if err != nil {
+			return nil, err
+		}
+		values[opt] = value
+	}
+	return values, nil
+}
+
+// SetMSS uses syscall to set the MSS value on a connection.
+func SetMSS(tcp *net.TCPListener, mss int) error {
+	return SetSockOpt(tcp, SockOptMSS, mss)
+}
@@ -0,0 +1,28 @@
+package tcpinfo
+
+import "syscall"
+
+// tcpNotSentLowat is TCP_NOTSENT_LOWAT, which syscall lacks on some
+// architectures.
+const tcpNotSentLowat = 0x201
+
+// sockOptLevels contains the socket options supported on Darwin, which
+// lacks SO_MAX_PACING_RATE and TCP_USER_TIMEOUT.
+var sockOptLevels = map[SockOpt]sockOptLevel{
+	SockOptMSS:          {syscall.IPPROTO_TCP, syscall.TCP_MAXSEG},
+	SockOptSndBuf:       {syscall.SOL_SOCKET, syscall.SO_SNDBUF},
+	SockOptRcvBuf:       {syscall.SOL_SOCKET, syscall.SO_RCVBUF},
+	SockOptNoDelay:      {syscall.IPPROTO_TCP, syscall.TCP_NODELAY},
+	SockOptNotSentLowat: {syscall.IPPROTO_TCP, tcpNotSentLowat},
+}
+
+// getSockOptUint64 reads the 64-bit socket option |l| of |fd|. None of
+// the options supported on Darwin are 64-bit wide.
+func getSockOptUint64(fd uintptr, l sockOptLevel) (uint64, error) {
+	return 0, &UnsupportedError{What: "64-bit socket options"}
+}
+
+// setSockOptUint64 sets the 64-bit socket option |l| of |fd| to |value|.
+func setSockOptUint64(fd uintptr, l sockOptLevel, value uint64) error {
+	return &UnsupportedError{What: "64-bit socket options"}
+}
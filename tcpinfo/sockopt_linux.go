@@ -0,0 +1,41 @@
+package tcpinfo
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Socket options missing from syscall.
+const (
+	tcpUserTimeout  = 18
+	tcpNotSentLowat = 25
+	soMaxPacingRate = 47
+)
+
+// sockOptLevels contains the socket options supported on Linux.
+var sockOptLevels = map[SockOpt]sockOptLevel{
+	SockOptMSS:           {syscall.SOL_TCP, syscall.TCP_MAXSEG},
+	SockOptSndBuf:        {syscall.SOL_SOCKET, syscall.SO_SNDBUF},
+	SockOptRcvBuf:        {syscall.SOL_SOCKET, syscall.SO_RCVBUF},
+	SockOptNoDelay:       {syscall.SOL_TCP, syscall.TCP_NODELAY},
+	SockOptNotSentLowat:  {syscall.SOL_TCP, tcpNotSentLowat},
+	SockOptMaxPacingRate: {syscall.SOL_SOCKET, soMaxPacingRate},
+	SockOptUserTimeout:   {syscall.SOL_TCP, tcpUserTimeout},
+}
+
+// getSockOptUint64 reads the 64-bit socket option |l| of |fd|.
+func getSockOptUint64(fd uintptr, l sockOptLevel) (uint64, error) {
+	var value uint64
+	_, err := getsockopt(fd, l.level, l.name, (*[8]byte)(unsafe.Pointer(&value))[:])
+	return value, err
+}
+
+// setSockOptUint64 sets the 64-bit socket option |l| of |fd| to |value|.
+func setSockOptUint64(fd uintptr, l sockOptLevel, value uint64) error {
+	if _, _, e1 := syscall.Syscall6(syscall.SYS_SETSOCKOPT, fd, uintptr(l.level),
+		uintptr(l.name), uintptr(unsafe.Pointer(&value)), unsafe.Sizeof(value), 0); e1 != 0 {
+		return os.NewSyscallError("setsockopt", e1)
+	}
+	return nil
+}
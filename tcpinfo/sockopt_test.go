@@ -0,0 +1,105 @@
+package tcpinfo_test
+
+import (
+	"net"
+	"runtime"
+	"testing"
+
+	"github.com/m-lab/ndt-server-go/tcpinfo"
+)
+
+func TestSetSockOptsOnListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	effective, err := tcpinfo.SetSockOpts(ln.(*net.TCPListener), map[tcpinfo.SockOpt]int{
+		tcpinfo.SockOptMSS:    1200,
+		tcpinfo.SockOptSndBuf: 65536,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(effective) != 2 || effective[tcpinfo.SockOptSndBuf] < 65536 {
+		t.Error("unexpected effective values: ", effective)
+	}
+}
+
+func TestSetSockOptsOnConn(t *testing.T) {
+	conn, cleanup := dialLoopback(t)
+	defer cleanup()
+	opts := map[tcpinfo.SockOpt]int{
+		tcpinfo.SockOptRcvBuf:       131072,
+		tcpinfo.SockOptNoDelay:      0,
+		tcpinfo.SockOptNotSentLowat: 16384,
+	}
+	if runtime.GOOS == "linux" {
+		opts[tcpinfo.SockOptMaxPacingRate] = 1000000
+		opts[tcpinfo.SockOptUserTimeout] = 30000
+	}
+	effective, err := tcpinfo.SetSockOpts(conn, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for opt, value := range opts {
+		if opt == tcpinfo.SockOptRcvBuf {
+			// The kernel may round or double the buffer sizes
+			if effective[opt] < value {
+				t.Errorf("%s: expected at least %d, got %d", opt, value, effective[opt])
+			}
+		} else if effective[opt] != value {
+			t.Errorf("%s: expected %d, got %d", opt, value, effective[opt])
+		}
+	}
+	values, err := tcpinfo.GetSockOpts(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values[tcpinfo.SockOptNotSentLowat] != 16384 || values[tcpinfo.SockOptMSS] <= 0 {
+		t.Error("unexpected values: ", values)
+	}
+}
+
+func TestSockOptUnsupported(t *testing.T) {
+	conn, cleanup := dialLoopback(t)
+	defer cleanup()
+	err := tcpinfo.SetSockOpt(conn, tcpinfo.SockOpt(-1), 1)
+	if !tcpinfo.IsUnsupported(err) {
+		t.Error("expected an UnsupportedError, got: ", err)
+	}
+	if runtime.GOOS == "darwin" {
+		_, err = tcpinfo.GetSockOpt(conn, tcpinfo.SockOptUserTimeout)
+		if !tcpinfo.IsUnsupported(err) {
+			t.Error("expected an UnsupportedError, got: ", err)
+		}
+	}
+}
+
+func TestMaxPacingRate(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_MAX_PACING_RATE is only supported on Linux")
+	}
+	conn, cleanup := dialLoopback(t)
+	defer cleanup()
+	rate, err := tcpinfo.GetSockOpt(conn, tcpinfo.SockOptMaxPacingRate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rate != tcpinfo.UnlimitedPacingRate {
+		t.Error("expected an unlimited pacing rate by default, got: ", rate)
+	}
+	// Rates above 4 GB/s do not fit in 32 bits.
+	const fast = 1 << 33
+	err = tcpinfo.SetSockOpt(conn, tcpinfo.SockOptMaxPacingRate, fast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rate, err = tcpinfo.GetSockOpt(conn, tcpinfo.SockOptMaxPacingRate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rate != fast {
+		t.Errorf("expected %d, got %d", fast, rate)
+	}
+}
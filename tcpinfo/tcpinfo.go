@@ -0,0 +1,366 @@
+package tcpinfo
+
+import (
+	"encoding/binary"
+	"unsafe"
+)
+
+// TCPInfo contains the fields of the Linux struct tcp_info. Since older
+// kernels return a shorter struct, Present tells which fields have been
+// returned by the kernel. Fields that are not present are zero. Times are
+// in microseconds unless otherwise noted.
+type TCPInfo struct {
+	State                  uint8
+	CAState                uint8
+	Retransmits            uint8
+	Probes                 uint8
+	Backoff                uint8
+	Options                uint8
+	SndWScale              uint8
+	RcvWScale              uint8
+	DeliveryRateAppLimited bool
+	FastOpenClientFail     uint8
+
+	RTO    uint32
+	ATO    uint32
+	SndMSS uint32
+	RcvMSS uint32
+
+	Unacked uint32
+	Sacked  uint32
+	Lost    uint32
+	Retrans uint32
+	Fackets uint32
+
+	// Times in milliseconds.
+	LastDataSent uint32
+	LastAckSent  uint32
+	LastDataRecv uint32
+	LastAckRecv  uint32
+
+	PMTU        uint32
+	RcvSsthresh uint32
+	RTT         uint32
+	RTTVar      uint32
+	SndSsthresh uint32
+	SndCwnd     uint32
+	AdvMSS      uint32
+	Reordering  uint32
+
+	RcvRTT   uint32
+	RcvSpace uint32
+
+	TotalRetrans uint32
+
+	// Rates in bytes per second.
+	PacingRate    uint64
+	MaxPacingRate uint64
+
+	BytesAcked    uint64
+	BytesReceived uint64
+	SegsOut       uint32
+	SegsIn        uint32
+
+	NotsentBytes uint32
+	MinRTT       uint32
+	DataSegsIn   uint32
+	DataSegsOut  uint32
+
+	DeliveryRate uint64
+
+	BusyTime      uint64
+	RwndLimited   uint64
+	SndbufLimited uint64
+
+	Delivered   uint32
+	DeliveredCE uint32
+
+	BytesSent    uint64
+	BytesRetrans uint64
+	DSACKDups    uint32
+	ReordSeen    uint32
+
+	RcvOOOPack uint32
+
+	SndWnd uint32
+	RcvWnd uint32
+
+	Rehash uint32
+
+	TotalRTO           uint16
+	TotalRTORecoveries uint16
+	// Time in milliseconds.
+	TotalRTOTime uint32
+
+	// Present contains the fields returned by the kernel.
+	Present FieldSet
+}
+
+// Field identifies a field of TCPInfo.
+type Field uint
+
+// The fields of TCPInfo, in the order in which they appear in tcp_info.
+const (
+	FieldState Field = iota
+	FieldCAState
+	FieldRetransmits
+	FieldProbes
+	FieldBackoff
+	FieldOptions
+	FieldSndWScale
+	FieldRcvWScale
+	FieldDeliveryRateAppLimited
+	FieldFastOpenClientFail
+	FieldRTO
+	FieldATO
+	FieldSndMSS
+	FieldRcvMSS
+	FieldUnacked
+	FieldSacked
+	FieldLost
+	FieldRetrans
+	FieldFackets
+	FieldLastDataSent
+	FieldLastAckSent
+	FieldLastDataRecv
+	FieldLastAckRecv
+	FieldPMTU
+	FieldRcvSsthresh
+	FieldRTT
+	FieldRTTVar
+	FieldSndSsthresh
+	FieldSndCwnd
+	FieldAdvMSS
+	FieldReordering
+	FieldRcvRTT
+	FieldRcvSpace
+	FieldTotalRetrans
+	FieldPacingRate
+	FieldMaxPacingRate
+	FieldBytesAcked
+	FieldBytesReceived
+	FieldSegsOut
+	FieldSegsIn
+	FieldNotsentBytes
+	FieldMinRTT
+	FieldDataSegsIn
+	FieldDataSegsOut
+	FieldDeliveryRate
+	FieldBusyTime
+	FieldRwndLimited
+	FieldSndbufLimited
+	FieldDelivered
+	FieldDeliveredCE
+	FieldBytesSent
+	FieldBytesRetrans
+	FieldDSACKDups
+	FieldReordSeen
+	FieldRcvOOOPack
+	FieldSndWnd
+	FieldRcvWnd
+	FieldRehash
+	FieldTotalRTO
+	FieldTotalRTORecoveries
+	FieldTotalRTOTime
+)
+
+// FieldSet is a bitmap of fields.
+type FieldSet uint64
+
+// Has returns whether |f| is in the set.
+func (fs FieldSet) Has(f Field) bool {
+	return fs&(1<<f) != 0
+}
+
+// Has returns whether the kernel returned the field |f|.
+func (info *TCPInfo) Has(f Field) bool {
+	return info.Present.Has(f)
+}
+
+// Bits of the Options field.
+const (
+	OptTimestamps = 1
+	OptSACK       = 2
+	OptWScale     = 4
+	OptECN        = 8
+	OptECNSeen    = 16
+	OptSYNData    = 32
+)
+
+// MaxSize is the size of the longest tcp_info that we know how to decode.
+// Longer buffers are decoded up to MaxSize.
+const MaxSize = 248
+
+// bigEndian indicates whether the host is big endian, which affects both
+// the byte order and the layout of the bit fields.
+var bigEndian = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 0
+}()
+
+// nativeEndian is the byte order of the host.
+var nativeEndian = func() binary.ByteOrder {
+	if bigEndian {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}()
+
+// decoder decodes the fields of tcp_info in order, marking as present the
+// fields that fit into the buffer.
+type decoder struct {
+	buf     []byte
+	off     int
+	order   binary.ByteOrder
+	present FieldSet
+}
+
+// next returns the next |size| bytes, or nil if the buffer is too short,
+// in which case the field |f| is not present.
+func (d *decoder) next(f Field, size int) []byte {
+	off := d.off
+	d.off += size
+	if d.off > len(d.buf) {
+		return nil
+	}
+	d.present |= 1 << f
+	return d.buf[off:d.off]
+}
+
+func (d *decoder) u8(f Field) uint8 {
+	if b := d.next(f, 1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) u16(f Field) uint16 {
+	if b := d.next(f, 2); b != nil {
+		return d.order.Uint16(b)
+	}
+	return 0
+}
+
+func (d *decoder) u32(f Field) uint32 {
+	if b := d.next(f, 4); b != nil {
+		return d.order.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) u64(f Field) uint64 {
+	if b := d.next(f, 8); b != nil {
+		return d.order.Uint64(b)
+	}
+	return 0
+}
+
+// bits decodes a byte containing two bit fields and marks both as present.
+// The field |lo| is |loBits| wide and is declared first, the field |hi|
+// takes the remaining bits. Returns the values of |lo| and |hi|.
+func (d *decoder) bits(lo, hi Field, loBits uint) (uint8, uint8) {
+	b := d.next(lo, 1)
+	if b == nil {
+		return 0, 0
+	}
+	d.present |= 1 << hi
+	mask := uint8(1)<<loBits - 1
+	if bigEndian {
+		// Bit fields are allocated starting from the most significant bit
+		return b[0] >> (8 - loBits) & mask, b[0] << loBits >> loBits
+	}
+	return b[0] & mask, b[0] >> loBits
+}
+
+// Decode decodes the tcp_info returned by the kernel in |buf|, which may
+// be shorter or longer than the struct we know.
+func Decode(buf []byte) *TCPInfo {
+	d := &decoder{buf: buf, order: nativeEndian}
+	info := &TCPInfo{}
+	info.State = d.u8(FieldState)
+	info.CAState = d.u8(FieldCAState)
+	info.Retransmits = d.u8(FieldRetransmits)
+	info.Probes = d.u8(FieldProbes)
+	info.Backoff = d.u8(FieldBackoff)
+	info.Options = d.u8(FieldOptions)
+	info.SndWScale, info.RcvWScale = d.bits(FieldSndWScale, FieldRcvWScale, 4)
+	limited, fastOpen := d.bits(FieldDeliveryRateAppLimited,
+		FieldFastOpenClientFail, 1)
+	info.DeliveryRateAppLimited = limited != 0
+	// fastopen_client_fail is 2 bits wide, the remaining bits are unused
+	if bigEndian {
+		info.FastOpenClientFail = fastOpen >> 5
+	} else {
+		info.FastOpenClientFail = fastOpen & 3
+	}
+
+	info.RTO = d.u32(FieldRTO)
+	info.ATO = d.u32(FieldATO)
+	info.SndMSS = d.u32(FieldSndMSS)
+	info.RcvMSS = d.u32(FieldRcvMSS)
+
+	info.Unacked = d.u32(FieldUnacked)
+	info.Sacked = d.u32(FieldSacked)
+	info.Lost = d.u32(FieldLost)
+	info.Retrans = d.u32(FieldRetrans)
+	info.Fackets = d.u32(FieldFackets)
+
+	info.LastDataSent = d.u32(FieldLastDataSent)
+	info.LastAckSent = d.u32(FieldLastAckSent)
+	info.LastDataRecv = d.u32(FieldLastDataRecv)
+	info.LastAckRecv = d.u32(FieldLastAckRecv)
+
+	info.PMTU = d.u32(FieldPMTU)
+	info.RcvSsthresh = d.u32(FieldRcvSsthresh)
+	info.RTT = d.u32(FieldRTT)
+	info.RTTVar = d.u32(FieldRTTVar)
+	info.SndSsthresh = d.u32(FieldSndSsthresh)
+	info.SndCwnd = d.u32(FieldSndCwnd)
+	info.AdvMSS = d.u32(FieldAdvMSS)
+	info.Reordering = d.u32(FieldReordering)
+
+	info.RcvRTT = d.u32(FieldRcvRTT)
+	info.RcvSpace = d.u32(FieldRcvSpace)
+
+	info.TotalRetrans = d.u32(FieldTotalRetrans)
+
+	info.PacingRate = d.u64(FieldPacingRate)
+	info.MaxPacingRate = d.u64(FieldMaxPacingRate)
+	info.BytesAcked = d.u64(FieldBytesAcked)
+	info.BytesReceived = d.u64(FieldBytesReceived)
+	info.SegsOut = d.u32(FieldSegsOut)
+	info.SegsIn = d.u32(FieldSegsIn)
+
+	info.NotsentBytes = d.u32(FieldNotsentBytes)
+	info.MinRTT = d.u32(FieldMinRTT)
+	info.DataSegsIn = d.u32(FieldDataSegsIn)
+	info.DataSegsOut = d.u32(FieldDataSegsOut)
+
+	info.DeliveryRate = d.u64(FieldDeliveryRate)
+
+	info.BusyTime = d.u64(FieldBusyTime)
+	info.RwndLimited = d.u64(FieldRwndLimited)
+	info.SndbufLimited = d.u64(FieldSndbufLimited)
+
+	info.Delivered = d.u32(FieldDelivered)
+	info.DeliveredCE = d.u32(FieldDeliveredCE)
+
+	info.BytesSent = d.u64(FieldBytesSent)
+	info.BytesRetrans = d.u64(FieldBytesRetrans)
+	info.DSACKDups = d.u32(FieldDSACKDups)
+	info.ReordSeen = d.u32(FieldReordSeen)
+
+	info.RcvOOOPack = d.u32(FieldRcvOOOPack)
+
+	info.SndWnd = d.u32(FieldSndWnd)
+	info.RcvWnd = d.u32(FieldRcvWnd)
+
+	info.Rehash = d.u32(FieldRehash)
+
+	info.TotalRTO = d.u16(FieldTotalRTO)
+	info.TotalRTORecoveries = d.u16(FieldTotalRTORecoveries)
+	info.TotalRTOTime = d.u32(FieldTotalRTOTime)
+
+	info.Present = d.present
+	return info
+}
@@ -1,21 +1,49 @@
 package tcpinfo
 
 import (
-	"errors"
 	"net"
 	"syscall"
 )
 
 var (
-	ErrNoTCPInfoSupport = errors.New("OS does not support TCPInfo")
+	ErrNoTCPInfoSupport error = &UnsupportedError{What: "TCP_INFO"}
 )
 
 // Alternate (better) way to get tcpinfo
-func TCPInfo2(conn *net.TCPConn) (*syscall.TCPInfo, error) {
+func TCPInfo2(conn *net.TCPConn) (*TCPInfo, error) {
 	return nil, ErrNoTCPInfoSupport
 }
 
-// SetMSS uses syscall to set the MSS value on a connection.
-func SetMSS(tcp *net.TCPListener, mss int) error {
-	return nil
+// RawTCPInfo reads TCP_INFO from the socket of |rc|.
+func RawTCPInfo(rc syscall.RawConn) (*TCPInfo, error) {
+	return nil, ErrNoTCPInfoSupport
+}
+
+// Congestion returns the name of the congestion control algorithm used by
+// |conn|.
+func Congestion(conn syscall.Conn) (string, error) {
+	return "", &UnsupportedError{What: "TCP_CONGESTION"}
+}
+
+// SetCongestion sets the congestion control algorithm of |conn| to |name|.
+func SetCongestion(conn syscall.Conn, name string) error {
+	return &UnsupportedError{What: "TCP_CONGESTION"}
+}
+
+// CongestionInfo returns the congestion control algorithm used by |conn|
+// along with its TCP_CC_INFO.
+func CongestionInfo(conn syscall.Conn) (*CCInfo, error) {
+	return nil, &UnsupportedError{What: "TCP_CC_INFO"}
+}
+
+// OutQueue returns the number of bytes in the send queue of |conn| that
+// have not been acknowledged yet.
+func OutQueue(conn syscall.Conn) (int, error) {
+	return 0, &UnsupportedError{What: "SIOCOUTQ"}
+}
+
+// DumpTCP returns the state of the TCP sockets whose local port is in
+// |ports|, or of all the TCP sockets if |ports| is empty.
+func DumpTCP(ports map[int]bool) ([]*DiagSocket, error) {
+	return nil, &UnsupportedError{What: "sock_diag"}
 }
@@ -1,44 +1,154 @@
 package tcpinfo
 
 import (
-	"errors"
-	"log"
 	"net"
+	"os"
 	"syscall"
 	"unsafe"
 )
 
-// TCPInfo2 implements better way to get tcpinfo
-func TCPInfo2(conn *net.TCPConn) (*syscall.TCPInfo, error) {
-	file, err := conn.File()
+// getTCPInfo reads TCP_INFO from |fd|.
+func getTCPInfo(fd uintptr) (*TCPInfo, error) {
+	var buf [MaxSize]byte
+	infoLen := uint32(len(buf))
+	if _, _, e1 := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.SOL_TCP,
+		syscall.TCP_INFO, uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&infoLen)), 0); e1 != 0 {
+		return nil, os.NewSyscallError("getsockopt", e1)
+	}
+	return Decode(buf[:infoLen]), nil
+}
+
+// RawTCPInfo reads TCP_INFO from the socket of |rc|. Callers reading
+// TCP_INFO many times from the same connection should obtain |rc| once
+// using SyscallConn and call RawTCPInfo repeatedly.
+func RawTCPInfo(rc syscall.RawConn) (*TCPInfo, error) {
+	var info *TCPInfo
+	err := control(rc, func(fd uintptr) error {
+		var err error
+		info, err = getTCPInfo(fd)
+		return err
+	})
+	return info, err
+}
+
+// TCPInfo2 implements better way to get tcpinfo. Only the fields returned
+// by the running kernel are present in the result.
+func TCPInfo2(conn *net.TCPConn) (*TCPInfo, error) {
+	rc, err := conn.SyscallConn()
 	if err != nil {
-		log.Println("error in getting file for the connection!")
 		return nil, err
 	}
-	defer file.Close()
-	fd := file.Fd()
+	return RawTCPInfo(rc)
+}
 
-	var info syscall.TCPInfo
-	infoLen := uint32(syscall.SizeofTCPInfo)
-	if _, _, e1 := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.SOL_TCP,
-		syscall.TCP_INFO, uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&infoLen)), 0); e1 != 0 {
-		return nil, errors.New("Syscall error")
+// tcpCCInfo is the TCP_CC_INFO socket option, which syscall lacks.
+const tcpCCInfo = 26
+
+// maxCongestionName is the size of a congestion control name including
+// the terminating NUL (TCP_CA_NAME_MAX).
+const maxCongestionName = 16
+
+// getsockopt reads the socket option |opt| at |level| of |fd| into |buf|
+// and returns the length returned by the kernel.
+func getsockopt(fd uintptr, level, opt int, buf []byte) (int, error) {
+	bufLen := uint32(len(buf))
+	if _, _, e1 := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, uintptr(level),
+		uintptr(opt), uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&bufLen)), 0); e1 != 0 {
+		return 0, os.NewSyscallError("getsockopt", e1)
 	}
-	return &info, nil
+	return int(bufLen), nil
 }
 
-// SetMSS uses syscall to set the MSS value on a connection.
-func SetMSS(tcp *net.TCPListener, mss int) error {
-	file, err := tcp.File()
+// getCongestion reads the name of the congestion control of |fd|.
+func getCongestion(fd uintptr) (string, error) {
+	var buf [maxCongestionName]byte
+	n, err := getsockopt(fd, syscall.SOL_TCP, syscall.TCP_CONGESTION, buf[:])
 	if err != nil {
-		log.Println("error in getting file for the connection!")
-		return err
+		return "", err
 	}
-	defer file.Close()
-	err = syscall.SetsockoptInt(int(file.Fd()), syscall.SOL_TCP, syscall.TCP_MAXSEG, mss)
+	return cString(buf[:n]), nil
+}
+
+// cString returns the NUL terminated string at the beginning of |b|.
+func cString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
+
+// Congestion returns the name of the congestion control algorithm used by
+// |conn|, e.g. "cubic".
+func Congestion(conn syscall.Conn) (string, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	var name string
+	err = control(rc, func(fd uintptr) error {
+		var err error
+		name, err = getCongestion(fd)
+		return err
+	})
+	return name, err
+}
+
+// SetCongestion sets the congestion control algorithm of |conn| to |name|,
+// e.g. "bbr". When |conn| is a listener, the accepted connections inherit
+// the algorithm. Fails if the algorithm is not available.
+func SetCongestion(conn syscall.Conn, name string) error {
+	rc, err := conn.SyscallConn()
 	if err != nil {
-		log.Println("error in setting MSS option on socket:", err)
 		return err
 	}
-	return nil
+	return control(rc, func(fd uintptr) error {
+		err := syscall.SetsockoptString(int(fd), syscall.SOL_TCP,
+			syscall.TCP_CONGESTION, name)
+		return os.NewSyscallError("setsockopt", err)
+	})
+}
+
+// CongestionInfo returns the congestion control algorithm used by |conn|
+// along with its TCP_CC_INFO, if the algorithm exports it.
+func CongestionInfo(conn syscall.Conn) (*CCInfo, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var info *CCInfo
+	err = control(rc, func(fd uintptr) error {
+		name, err := getCongestion(fd)
+		if err != nil {
+			return err
+		}
+		var buf [sizeofBBRInfo]byte
+		n, err := getsockopt(fd, syscall.SOL_TCP, tcpCCInfo, buf[:])
+		if err != nil {
+			return err
+		}
+		info = DecodeCCInfo(name, buf[:n])
+		return nil
+	})
+	return info, err
+}
+
+// OutQueue returns the number of bytes in the send queue of |conn| that
+// have not been acknowledged yet, including those not sent yet (SIOCOUTQ).
+func OutQueue(conn syscall.Conn) (int, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var queued int32
+	err = control(rc, func(fd uintptr) error {
+		_, _, e1 := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCOUTQ,
+			uintptr(unsafe.Pointer(&queued)))
+		if e1 != 0 {
+			return os.NewSyscallError("ioctl", e1)
+		}
+		return nil
+	})
+	return int(queued), err
 }
@@ -0,0 +1,164 @@
+package tcpinfo_test
+
+import (
+	"io/ioutil"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/m-lab/ndt-server-go/tcpinfo"
+)
+
+// tcpInfoFile reads TCP_INFO like TCPInfo2 used to do, using File(), which
+// duplicates the file descriptor. Used to compare with TCPInfo2.
+func tcpInfoFile(conn *net.TCPConn) (*tcpinfo.TCPInfo, error) {
+	file, err := conn.File()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var buf [tcpinfo.MaxSize]byte
+	infoLen := uint32(len(buf))
+	if _, _, e1 := syscall.Syscall6(syscall.SYS_GETSOCKOPT, file.Fd(),
+		syscall.SOL_TCP, syscall.TCP_INFO, uintptr(unsafe.Pointer(&buf[0])),
+		uintptr(unsafe.Pointer(&infoLen)), 0); e1 != 0 {
+		return nil, e1
+	}
+	return tcpinfo.Decode(buf[:infoLen]), nil
+}
+
+func BenchmarkTCPInfoFile(b *testing.B) {
+	conn, cleanup := dialLoopback(b)
+	defer cleanup()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := tcpInfoFile(conn); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRawTCPInfo(b *testing.B) {
+	conn, cleanup := dialLoopback(b)
+	defer cleanup()
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := tcpinfo.RawTCPInfo(rc); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestTCPInfo2KeepsNonBlocking(t *testing.T) {
+	conn, cleanup := dialLoopback(t)
+	defer cleanup()
+	_, err := tcpinfo.TCPInfo2(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var flags uintptr
+	var errno syscall.Errno
+	rc.Control(func(fd uintptr) {
+		flags, _, errno = syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_GETFL, 0)
+	})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	if flags&syscall.O_NONBLOCK == 0 {
+		t.Error("the socket should still be non-blocking")
+	}
+}
+
+// availableCongestion returns whether the congestion control |name| can be
+// used by unprivileged processes.
+func availableCongestion(name string) bool {
+	data, err := ioutil.ReadFile("/proc/sys/net/ipv4/tcp_allowed_congestion_control")
+	if err != nil {
+		return false
+	}
+	for _, allowed := range strings.Fields(string(data)) {
+		if allowed == name {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSetCongestion(t *testing.T) {
+	conn, cleanup := dialLoopback(t)
+	defer cleanup()
+	for _, name := range []string{"reno", "cubic", "bbr"} {
+		if !availableCongestion(name) {
+			continue
+		}
+		err := tcpinfo.SetCongestion(conn, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		current, err := tcpinfo.Congestion(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if current != name {
+			t.Errorf("expected %s, got %s", name, current)
+		}
+		info, err := tcpinfo.CongestionInfo(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Algorithm != name || (name == "bbr") != (info.BBR != nil) {
+			t.Errorf("unexpected info for %s: %+v", name, info)
+		}
+	}
+	if err := tcpinfo.SetCongestion(conn, "no-such-algorithm"); err == nil {
+		t.Error("setting an unknown algorithm should fail")
+	}
+}
+
+// fillSendQueue writes to |conn|, whose peer does not read, until the
+// send buffer is full.
+func fillSendQueue(t *testing.T, conn *net.TCPConn) {
+	buf := make([]byte, 64*1024)
+	for {
+		conn.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+		_, err := conn.Write(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return
+			}
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOutQueue(t *testing.T) {
+	conn, cleanup := dialLoopback(t)
+	defer cleanup()
+	if queued, err := tcpinfo.OutQueue(conn); err != nil || queued != 0 {
+		t.Fatal("unexpected queue of an idle connection: ", queued, err)
+	}
+	fillSendQueue(t, conn)
+	queued, err := tcpinfo.OutQueue(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := tcpinfo.TCPInfo2(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queued <= 0 || (info.Has(tcpinfo.FieldNotsentBytes) &&
+		int(info.NotsentBytes) > queued) {
+		t.Error("unexpected queue: ", queued, info.NotsentBytes)
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"net"
 	"os"
 	"sync"
-	"syscall"
 	"testing"
 
 	"github.com/m-lab/ndt-server-go/tcpinfo"
@@ -44,7 +43,7 @@ func BenchmarkTCPInfo2(b *testing.B) {
 	}
 	defer dialer.Close()
 
-	var info *syscall.TCPInfo
+	var info *tcpinfo.TCPInfo
 	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
 		info, _ = tcpinfo.TCPInfo2(dialer.(*net.TCPConn))
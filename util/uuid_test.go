@@ -0,0 +1,29 @@
+// Part of ndt-server-go <https://github.com/m-lab/ndt-server-go>, which
+// is free software under the Apache v2.0 License.
+
+package util
+
+import (
+	"regexp"
+	"testing"
+)
+
+// TestNewUUID makes sure that we generate well formed and unique UUIDs.
+func TestNewUUID(t *testing.T) {
+	re := regexp.MustCompile(
+		`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	seen := make(map[string]bool)
+	for i := 0; i < 128; i++ {
+		uuid, err := NewUUID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !re.MatchString(uuid) {
+			t.Error("malformed UUID: ", uuid)
+		}
+		if seen[uuid] {
+			t.Error("duplicate UUID: ", uuid)
+		}
+		seen[uuid] = true
+	}
+}